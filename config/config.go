@@ -1,60 +1,242 @@
 package config
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
-	"log"
-	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
 )
 
 type Config struct {
-	Port                   string   `json:"port"`
-	BaseUrl                string   `json:"baseUrl"`
-	BasePath               string   `json:"basePath"`
-	EncryptionSecret       string   `json:"encryptionSecret"`
-	ThumbnailQuality       int      `json:"thumbnailQuality"`
-	HashFilename           bool     `json:"hashFilename"`
-	PinToIpfs              bool     `json:"pinToIpfs"`
-	WhitelistedTokens      []string `json:"whitelistedTokens"`
-	WhitelistedIpAddresses []string `json:"whitelistedIpAddresses"`
+	Port                   string          `json:"port"`
+	BaseUrl                string          `json:"baseUrl"`
+	BasePath               string          `json:"basePath"`
+	EncryptionSecret       string          `json:"encryptionSecret"`
+	ThumbnailQuality       int             `json:"thumbnailQuality"`
+	ThumbnailWorkers       int             `json:"thumbnailWorkers"`
+	BatchParallelism       int             `json:"batchParallelism"`
+	HashFilename           bool            `json:"hashFilename"`
+	PinToIpfs              bool            `json:"pinToIpfs"`
+	CidLayout              string          `json:"cidLayout"`
+	Ipfs                   *IpfsConfig     `json:"ipfs"`
+	WhitelistedTokens      []string        `json:"whitelistedTokens"`
+	WhitelistedIpAddresses []string        `json:"whitelistedIpAddresses"`
+	MetadataPolicy         *MetadataPolicy `json:"metadataPolicy"`
+	Index                  *IndexConfig    `json:"index"`
+	ThumbnailCache         *ThumbnailCache `json:"thumbnailCache"`
+	Scrubber               *Scrubber       `json:"scrubber"`
 }
 
-func NewConfig() *Config {
-	rand.Seed(time.Now().Unix())
+// IndexConfig selects where the metadata index lives. The default "bolt"
+// driver keeps an embedded database in basePath/.gouvre, "postgres" connects
+// to dsn.
+type IndexConfig struct {
+	Driver string `json:"driver"`
+	Dsn    string `json:"dsn"`
+}
 
-	cfg := &Config{}
-	configFile := "config.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+// ThumbnailCache bounds the thumbnails kept on disk. MaxSize is in bytes and
+// MaxAge is how long a thumbnail may go unserved; zero or empty disables the
+// limit. Interval is how often the janitor checks the cache.
+type ThumbnailCache struct {
+	MaxSize  int64  `json:"maxSize"`
+	MaxAge   string `json:"maxAge"`
+	Interval string `json:"interval"`
+}
+
+// MaxAgeDuration returns MaxAge parsed, or 0 if there is no age limit.
+func (c *ThumbnailCache) MaxAgeDuration() time.Duration {
+	d, _ := time.ParseDuration(c.MaxAge)
+	return d
+}
+
+// IntervalDuration returns Interval parsed.
+func (c *ThumbnailCache) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(c.Interval)
+	return d
+}
+
+// Scrubber sets how often stored originals are re-hashed to catch bit rot
+// or tampering. An empty Interval leaves it to the admin endpoint. With
+// Repair, damaged originals are restored from the IPFS node when their cid
+// is pinned there.
+type Scrubber struct {
+	Interval string `json:"interval"`
+	Repair   bool   `json:"repair"`
+}
+
+// IntervalDuration returns Interval parsed, or 0 when scrubbing only runs
+// on request.
+func (c *Scrubber) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(c.Interval)
+	return d
+}
+
+// IpfsConfig points at the HTTP API of the IPFS node used when pinToIpfs
+// is on. AuthHeader is sent as the Authorization header, for nodes behind
+// an authenticating proxy.
+type IpfsConfig struct {
+	ApiUrl        string                  `json:"apiUrl"`
+	AuthHeader    string                  `json:"authHeader"`
+	Timeout       string                  `json:"timeout"`
+	Retries       int                     `json:"retries"`
+	RemotePinning []*RemotePinningService `json:"remotePinning"`
+}
+
+// RemotePinningService is a service implementing the IPFS Pinning Service
+// API, such as Pinata, that pins are replicated to. Endpoint is the API
+// root, e.g. https://api.pinata.cloud/psa, and Token its access token.
+type RemotePinningService struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	Token    string `json:"token"`
+}
+
+// TimeoutDuration returns Timeout parsed.
+func (c *IpfsConfig) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
+}
+
+// MetadataPolicy lists the kinds of embedded metadata (exif, xmp, iptc, icc,
+// comment) to keep on upload; everything else is stripped. "*" keeps all.
+// Formats overrides Keep for a single format (jpeg, png, gif or bmp).
+//
+// Stripping happens before the cid is computed, so an upload that carried
+// stripped metadata gets a cid that differs from the hash of the client's
+// own bytes. Keep ["*"] without Formats stores every upload byte-for-byte.
+type MetadataPolicy struct {
+	Keep    []string            `json:"keep"`
+	Formats map[string][]string `json:"formats"`
+}
+
+// KeepFor returns the set of metadata kinds to keep for format, or nil if
+// everything should be kept.
+func (p *MetadataPolicy) KeepFor(format string) map[string]bool {
+	keep, ok := p.Formats[format]
+	if !ok {
+		keep = p.Keep
 	}
 
+	keepSet := make(map[string]bool)
+	for _, kind := range keep {
+		if kind == "*" {
+			return nil
+		}
+		keepSet[kind] = true
+	}
+
+	return keepSet
+}
+
+// ValidationError collects every problem found in a config file so they can
+// all be reported at once instead of one per restart.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+func (e *ValidationError) add(format string, a ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, a...))
+}
+
+func NewConfig(configFile string) (*Config, error) {
 	file, err := os.ReadFile(configFile)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		err := json.Unmarshal(file, cfg)
-		if err != nil {
-			fmt.Println("Unable to parse config file.")
-		}
+		return nil, err
+	}
+
+	cfg := &Config{}
+	verr := &ValidationError{}
+	for _, key := range unknownKeys(file) {
+		verr.add("unknown key %q", key)
+	}
+
+	err = json.Unmarshal(file, cfg)
+	if err != nil {
+		verr.add("unable to parse config file: %s", err)
+		return nil, verr
 	}
 
 	populateConfigWithDefaults(cfg)
 
-	return cfg
+	if err = cfg.Validate(); err != nil {
+		if ve, ok := err.(*ValidationError); ok {
+			verr.Problems = append(verr.Problems, ve.Problems...)
+		} else {
+			verr.add("%s", err)
+		}
+	}
+	if len(verr.Problems) > 0 {
+		return nil, verr
+	}
+
+	return cfg, nil
+}
+
+// Validate checks every field and returns a *ValidationError listing all
+// problems, or nil if the config is usable.
+func (cfg *Config) Validate() error {
+	verr := &ValidationError{}
+
+	validatePort(verr, cfg.Port)
+	validateBaseUrl(verr, cfg.BaseUrl)
+	validateBasePath(verr, cfg.BasePath)
+	validateThumbnailQuality(verr, cfg.ThumbnailQuality)
+	validateThumbnailWorkers(verr, cfg.ThumbnailWorkers)
+	validateBatchParallelism(verr, cfg.BatchParallelism)
+	validateWhitelistedTokens(verr, cfg.WhitelistedTokens)
+	validateWhitelistedIpAddresses(verr, cfg.WhitelistedIpAddresses)
+	validateMetadataPolicy(verr, cfg.MetadataPolicy)
+	validateIndex(verr, cfg.Index)
+	validateIpfs(verr, cfg.Ipfs)
+	validateCidLayout(verr, cfg.CidLayout)
+	validateThumbnailCache(verr, cfg.ThumbnailCache)
+	validateScrubber(verr, cfg.Scrubber)
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+
+	return nil
 }
 
 func populateConfigWithDefaults(cfg *Config) {
 	cfg.Port = configurePort(cfg.Port)
 	cfg.BaseUrl = configureBaseUrl(cfg.BaseUrl, cfg.Port)
-	cfg.BasePath = configureBasePath(cfg.BasePath)
 	cfg.EncryptionSecret = configureEncryptionSecret(cfg.EncryptionSecret)
 	cfg.ThumbnailQuality = configureThumbnailQuality(cfg.ThumbnailQuality)
+	cfg.ThumbnailWorkers = configureThumbnailWorkers(cfg.ThumbnailWorkers)
+	cfg.BatchParallelism = configureBatchParallelism(cfg.BatchParallelism)
 	cfg.WhitelistedTokens = configureWhitelistedTokens(cfg.WhitelistedTokens)
 	cfg.WhitelistedIpAddresses = configureWhitelistedIpAddresses(cfg.WhitelistedIpAddresses)
+	cfg.MetadataPolicy = configureMetadataPolicy(cfg.MetadataPolicy)
+	cfg.Index = configureIndex(cfg.Index)
+	cfg.Ipfs = configureIpfs(cfg.Ipfs)
+	cfg.CidLayout = configureCidLayout(cfg.CidLayout)
+	cfg.ThumbnailCache = configureThumbnailCache(cfg.ThumbnailCache)
+	cfg.Scrubber = configureScrubber(cfg.Scrubber)
+}
 
-	fmt.Printf("Writing images to %s\n", cfg.BasePath)
+func configureScrubber(scrubber *Scrubber) *Scrubber {
+	if scrubber == nil {
+		scrubber = &Scrubber{}
+	}
+	return scrubber
 }
 
 func configurePort(port string) string {
@@ -71,17 +253,6 @@ func configureBaseUrl(baseUrl, port string) string {
 	return baseUrl
 }
 
-func configureBasePath(basePath string) string {
-	if basePath == "" || basePathDoesNotExists(basePath) {
-		bp, err := os.MkdirTemp(os.TempDir(), "imageserver.*")
-		if err != nil {
-			log.Fatal("Couldn't create tmp directory")
-		}
-		basePath = bp
-	}
-	return basePath
-}
-
 func configureEncryptionSecret(encryptionSecret string) string {
 	if encryptionSecret == "" {
 		b := make([]byte, 256)
@@ -98,6 +269,20 @@ func configureThumbnailQuality(thumbnailQuality int) int {
 	return thumbnailQuality
 }
 
+func configureThumbnailWorkers(thumbnailWorkers int) int {
+	if thumbnailWorkers == 0 {
+		thumbnailWorkers = runtime.NumCPU()
+	}
+	return thumbnailWorkers
+}
+
+func configureBatchParallelism(batchParallelism int) int {
+	if batchParallelism == 0 {
+		batchParallelism = 4
+	}
+	return batchParallelism
+}
+
 func configureWhitelistedTokens(whitelistedTokens []string) []string {
 	if whitelistedTokens == nil {
 		whitelistedTokens = []string{"*"}
@@ -112,11 +297,296 @@ func configureWhitelistedIpAddresses(whitelistedIpAddresses []string) []string {
 	return whitelistedIpAddresses
 }
 
-func basePathDoesNotExists(basePath string) bool {
-	_, err := os.ReadDir(basePath)
+func configureMetadataPolicy(metadataPolicy *MetadataPolicy) *MetadataPolicy {
+	if metadataPolicy == nil {
+		metadataPolicy = &MetadataPolicy{}
+	}
+	if metadataPolicy.Keep == nil {
+		metadataPolicy.Keep = []string{helper.MetadataIcc}
+	}
+	return metadataPolicy
+}
+
+func configureIndex(indexConfig *IndexConfig) *IndexConfig {
+	if indexConfig == nil {
+		indexConfig = &IndexConfig{}
+	}
+	if indexConfig.Driver == "" {
+		indexConfig.Driver = index.DriverBolt
+	}
+	return indexConfig
+}
+
+func configureIpfs(ipfsConfig *IpfsConfig) *IpfsConfig {
+	if ipfsConfig == nil {
+		ipfsConfig = &IpfsConfig{}
+	}
+	if ipfsConfig.ApiUrl == "" {
+		ipfsConfig.ApiUrl = "http://localhost:5001"
+	}
+	if ipfsConfig.Timeout == "" {
+		ipfsConfig.Timeout = "60s"
+	}
+	return ipfsConfig
+}
+
+func configureCidLayout(cidLayout string) string {
+	if cidLayout == "" {
+		cidLayout = helper.CidLayoutRaw
+	}
+	return cidLayout
+}
+
+func configureThumbnailCache(thumbnailCache *ThumbnailCache) *ThumbnailCache {
+	if thumbnailCache == nil {
+		thumbnailCache = &ThumbnailCache{}
+	}
+	if thumbnailCache.Interval == "" {
+		thumbnailCache.Interval = "10m"
+	}
+	return thumbnailCache
+}
+
+func validatePort(verr *ValidationError, port string) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		verr.add("port %q must be a number between 1 and 65535", port)
+	}
+}
+
+func validateBaseUrl(verr *ValidationError, baseUrl string) {
+	u, err := url.Parse(baseUrl)
 	if err != nil {
-		return true
+		verr.add("baseUrl %q is not a valid url: %s", baseUrl, err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		verr.add("baseUrl %q must use http or https", baseUrl)
+	}
+	if u.Host == "" {
+		verr.add("baseUrl %q has no host", baseUrl)
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		verr.add("baseUrl %q must not end with a slash", baseUrl)
+	}
+}
+
+func validateBasePath(verr *ValidationError, basePath string) {
+	if basePath == "" {
+		verr.add("basePath is required")
+		return
+	}
+
+	info, err := os.Stat(basePath)
+	if err != nil {
+		verr.add("basePath %q does not exist", basePath)
+		return
+	}
+	if !info.IsDir() {
+		verr.add("basePath %q is not a directory", basePath)
+		return
+	}
+
+	f, err := os.CreateTemp(basePath, ".write-check.*")
+	if err != nil {
+		verr.add("basePath %q is not writable: %s", basePath, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func validateThumbnailQuality(verr *ValidationError, thumbnailQuality int) {
+	if thumbnailQuality < 1 || thumbnailQuality > 100 {
+		verr.add("thumbnailQuality %d must be between 1 and 100", thumbnailQuality)
+	}
+}
+
+func validateThumbnailWorkers(verr *ValidationError, thumbnailWorkers int) {
+	if thumbnailWorkers < 1 {
+		verr.add("thumbnailWorkers %d must be at least 1", thumbnailWorkers)
+	}
+}
+
+func validateBatchParallelism(verr *ValidationError, batchParallelism int) {
+	if batchParallelism < 1 {
+		verr.add("batchParallelism %d must be at least 1", batchParallelism)
+	}
+}
+
+func validateWhitelistedTokens(verr *ValidationError, whitelistedTokens []string) {
+	if len(whitelistedTokens) == 0 {
+		verr.add("whitelistedTokens is empty; every authenticated request would be rejected (use [\"*\"] to allow all)")
+		return
+	}
+	for i, token := range whitelistedTokens {
+		if strings.TrimSpace(token) == "" {
+			verr.add("whitelistedTokens[%d] is blank", i)
+		}
+	}
+}
+
+func validateWhitelistedIpAddresses(verr *ValidationError, whitelistedIpAddresses []string) {
+	if len(whitelistedIpAddresses) == 0 {
+		verr.add("whitelistedIpAddresses is empty; every authenticated request would be rejected (use [\"*\"] to allow all)")
+		return
+	}
+	for i, ipAddr := range whitelistedIpAddresses {
+		if ipAddr != "*" && net.ParseIP(ipAddr) == nil {
+			verr.add("whitelistedIpAddresses[%d] %q is not an ip address", i, ipAddr)
+		}
+	}
+}
+
+func validateMetadataPolicy(verr *ValidationError, metadataPolicy *MetadataPolicy) {
+	validateMetadataKinds(verr, "metadataPolicy.keep", metadataPolicy.Keep)
+	for format, keep := range metadataPolicy.Formats {
+		if !contains(helper.MetadataFormats, format) {
+			verr.add("metadataPolicy.formats has unknown format %q (expected one of %s)", format, strings.Join(helper.MetadataFormats, ", "))
+			continue
+		}
+		validateMetadataKinds(verr, fmt.Sprintf("metadataPolicy.formats.%s", format), keep)
+	}
+}
+
+func validateIndex(verr *ValidationError, indexConfig *IndexConfig) {
+	if !contains(index.Drivers, indexConfig.Driver) {
+		verr.add("index.driver %q must be one of %s", indexConfig.Driver, strings.Join(index.Drivers, ", "))
+	}
+	if indexConfig.Driver == index.DriverPostgres && indexConfig.Dsn == "" {
+		verr.add("index.dsn is required for the postgres driver")
+	}
+}
+
+func validateIpfs(verr *ValidationError, ipfsConfig *IpfsConfig) {
+	u, err := url.Parse(ipfsConfig.ApiUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		verr.add("ipfs.apiUrl %q must be an http or https url", ipfsConfig.ApiUrl)
+	}
+	d, err := time.ParseDuration(ipfsConfig.Timeout)
+	if err != nil || d <= 0 {
+		verr.add("ipfs.timeout %q must be a positive duration such as \"60s\"", ipfsConfig.Timeout)
+	}
+	if ipfsConfig.Retries < 0 {
+		verr.add("ipfs.retries %d must not be negative", ipfsConfig.Retries)
+	}
+
+	names := make(map[string]bool)
+	for i, service := range ipfsConfig.RemotePinning {
+		if service.Name == "" {
+			verr.add("ipfs.remotePinning[%d].name must not be empty", i)
+		} else if names[service.Name] {
+			verr.add("ipfs.remotePinning[%d].name %q is used more than once", i, service.Name)
+		}
+		names[service.Name] = true
+
+		u, err := url.Parse(service.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			verr.add("ipfs.remotePinning[%d].endpoint %q must be an http or https url", i, service.Endpoint)
+		}
+		if service.Token == "" {
+			verr.add("ipfs.remotePinning[%d].token must not be empty", i)
+		}
+	}
+}
+
+func validateCidLayout(verr *ValidationError, cidLayout string) {
+	if !contains(helper.CidLayouts, cidLayout) {
+		verr.add("cidLayout %q must be one of %s", cidLayout, strings.Join(helper.CidLayouts, ", "))
+	}
+}
+
+func validateThumbnailCache(verr *ValidationError, thumbnailCache *ThumbnailCache) {
+	if thumbnailCache.MaxSize < 0 {
+		verr.add("thumbnailCache.maxSize %d must not be negative", thumbnailCache.MaxSize)
+	}
+	if thumbnailCache.MaxAge != "" {
+		d, err := time.ParseDuration(thumbnailCache.MaxAge)
+		if err != nil || d <= 0 {
+			verr.add("thumbnailCache.maxAge %q must be a positive duration such as \"720h\"", thumbnailCache.MaxAge)
+		}
+	}
+	d, err := time.ParseDuration(thumbnailCache.Interval)
+	if err != nil || d < time.Second {
+		verr.add("thumbnailCache.interval %q must be a duration of at least 1s", thumbnailCache.Interval)
+	}
+}
+
+func validateScrubber(verr *ValidationError, scrubber *Scrubber) {
+	if scrubber.Interval != "" {
+		d, err := time.ParseDuration(scrubber.Interval)
+		if err != nil || d < time.Minute {
+			verr.add("scrubber.interval %q must be a duration of at least 1m", scrubber.Interval)
+		}
+	}
+}
+
+func validateMetadataKinds(verr *ValidationError, field string, kinds []string) {
+	for _, kind := range kinds {
+		if kind != "*" && !contains(helper.MetadataKinds, kind) {
+			verr.add("%s has unknown metadata kind %q (expected * or one of %s)", field, kind, strings.Join(helper.MetadataKinds, ", "))
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
 
 	return false
 }
+
+// unknownKeys returns the keys in the config file that don't map to a field,
+// including those of nested sections, as dotted paths such as
+// "ipfs.remotePinning[0].tokn".
+func unknownKeys(file []byte) []string {
+	unknown := []string{}
+	collectUnknownKeys(file, reflect.TypeOf(Config{}), "", &unknown)
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+func collectUnknownKeys(data []byte, t reflect.Type, path string, unknown *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		items := []json.RawMessage{}
+		if json.Unmarshal(data, &items) != nil {
+			return
+		}
+		for i, item := range items {
+			collectUnknownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), unknown)
+		}
+	case reflect.Struct:
+		raw := map[string]json.RawMessage{}
+		if json.Unmarshal(data, &raw) != nil {
+			return
+		}
+
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields[name] = t.Field(i).Type
+		}
+
+		for key, value := range raw {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				*unknown = append(*unknown, keyPath)
+				continue
+			}
+			collectUnknownKeys(value, fieldType, keyPath, unknown)
+		}
+	}
+}
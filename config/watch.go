@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watch reloads configFile whenever its modification time changes or the
+// process receives SIGHUP, and hands each successfully validated config to
+// onReload. Invalid configs are logged and ignored so the running settings
+// stay in place. Watch blocks forever and is meant to run in a goroutine.
+func Watch(configFile string, interval time.Duration, onReload func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastModTime := modTime(configFile)
+	for {
+		select {
+		case <-hup:
+			fmt.Println("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			mt := modTime(configFile)
+			if mt.Equal(lastModTime) {
+				continue
+			}
+			fmt.Printf("Detected change in %s, reloading config\n", configFile)
+		}
+		lastModTime = modTime(configFile)
+
+		cfg, err := NewConfig(configFile)
+		if err != nil {
+			fmt.Printf("Keeping current config: %s\n", err)
+			continue
+		}
+
+		onReload(cfg)
+	}
+}
+
+func modTime(configFile string) time.Time {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
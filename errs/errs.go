@@ -17,14 +17,26 @@ var ErrTooManyAttempts = fmt.Errorf("too many attempts tried")
 
 var ErrTokenNotFound = fmt.Errorf("token not found")
 
+var ErrNotFound = fmt.Errorf("not found")
+
 var ErrNotAuthorized = fmt.Errorf("not authorized")
 
 var ErrTokenExpired = fmt.Errorf("token expired")
 
+var ErrTokenRevoked = fmt.Errorf("token revoked")
+
 var ErrBadRequest = fmt.Errorf("bad request")
 
 var ErrGif = fmt.Errorf("image is a gif")
 
+var ErrRangeNotSatisfiable = fmt.Errorf("range not satisfiable")
+
+var ErrIpfsNotEnabled = fmt.Errorf("ipfs not enabled")
+
+var ErrScrubRunning = fmt.Errorf("scrub already running")
+
+var ErrReservedFilename = fmt.Errorf("filename is reserved")
+
 type ErrorResponse struct {
 	Code   int    `json:"code"`
 	Status string `json:"status"`
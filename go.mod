@@ -3,14 +3,18 @@ module github.com/sealsurlaw/gouvre
 go 1.17
 
 require (
+	github.com/disintegration/imaging v1.6.2
+	github.com/google/uuid v1.3.0
+	github.com/ipfs/go-cid v0.4.1
 	github.com/lib/pq v1.10.4
+	github.com/multiformats/go-multicodec v0.8.1
+	github.com/multiformats/go-multihash v0.2.1
+	go.etcd.io/bbolt v1.3.8
 	golang.org/x/image v0.0.0-20220321031419-a8550c1d254a
+	golang.org/x/sync v0.2.0
 )
 
 require (
-	github.com/disintegration/imaging v1.6.2 // indirect
-	github.com/google/uuid v1.3.0 // indirect
-	github.com/ipfs/go-cid v0.4.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/minio/blake2b-simd v0.0.0-20160723061019-3f5f724cb5b1 // indirect
 	github.com/minio/sha256-simd v1.0.0 // indirect
@@ -18,11 +22,9 @@ require (
 	github.com/multiformats/go-base32 v0.0.3 // indirect
 	github.com/multiformats/go-base36 v0.1.0 // indirect
 	github.com/multiformats/go-multibase v0.0.3 // indirect
-	github.com/multiformats/go-multicodec v0.8.1 // indirect
-	github.com/multiformats/go-multihash v0.2.1 // indirect
 	github.com/multiformats/go-varint v0.0.6 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	golang.org/x/crypto v0.1.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	lukechampine.com/blake3 v1.1.6 // indirect
 )
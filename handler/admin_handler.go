@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/request"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func (h *Handler) GetCacheUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.getCacheUsage(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+func (h *Handler) getCacheUsage(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	thumbnails, _, err := h.listCachedThumbnails()
+	if err != nil {
+		response.SendError(w, 500, "Couldn't read thumbnail cache.", err)
+		return
+	}
+
+	limits := h.getThumbnailCache()
+	res := &response.CacheUsageResponse{
+		Thumbnails: len(thumbnails),
+		MaxSize:    limits.MaxSize,
+		MaxAge:     limits.MaxAge,
+	}
+	for _, thumbnail := range thumbnails {
+		res.Size += thumbnail.size
+		if res.OldestAccess == nil || thumbnail.lastAccess.Before(*res.OldestAccess) {
+			lastAccess := thumbnail.lastAccess
+			res.OldestAccess = &lastAccess
+		}
+	}
+
+	h.janitorMu.Lock()
+	if h.lastJanitorRun != nil {
+		res.LastRun = &h.lastJanitorRun.at
+		res.LastEvicted = h.lastJanitorRun.evicted
+		res.LastFreed = h.lastJanitorRun.freed
+	}
+	h.janitorMu.Unlock()
+
+	response.SendJson(w, res, 200)
+}
+
+func (h *Handler) Scrub(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.getScrub(w, r)
+		return
+	} else if r.Method == http.MethodPost {
+		h.startScrubRun(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+func (h *Handler) getScrub(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	h.scrubMu.Lock()
+	defer h.scrubMu.Unlock()
+
+	if h.lastScrubRun == nil {
+		response.SendError(w, 404, "No scrub has run yet.", errs.ErrNotFound)
+		return
+	}
+
+	response.SendJson(w, makeScrubResponse(h.lastScrubRun), 200)
+}
+
+// startScrubRun scrubs in the background, the progress is reported by GET.
+func (h *Handler) startScrubRun(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	repair := h.getScrubber().Repair
+	if repairParam := request.ParseRepair(r); repairParam != nil {
+		repair = *repairParam
+	}
+
+	run, err := h.startScrub(repair)
+	if err != nil {
+		response.SendError(w, 409, "Scrub already running.", err)
+		return
+	}
+	go h.scrub(run)
+
+	h.scrubMu.Lock()
+	res := makeScrubResponse(run)
+	h.scrubMu.Unlock()
+
+	response.SendJson(w, res, 202)
+}
+
+// makeScrubResponse copies run. Callers must hold scrubMu.
+func makeScrubResponse(run *scrubRun) *response.ScrubResponse {
+	res := &response.ScrubResponse{
+		Running:      run.running,
+		Repair:       run.repair,
+		StartedAt:    run.startedAt,
+		Checked:      run.checked,
+		Unverifiable: run.unverifiable,
+		Repaired:     run.repaired,
+		Problems:     []*response.ScrubProblemResponse{},
+		Error:        run.err,
+	}
+	if !run.running {
+		finishedAt := run.finishedAt
+		res.FinishedAt = &finishedAt
+	}
+	for _, problem := range run.problems {
+		res.Problems = append(res.Problems, &response.ScrubProblemResponse{
+			StoragePath: problem.storagePath,
+			Filenames:   problem.filenames,
+			Cid:         problem.cid,
+			Problem:     problem.problem,
+			Repaired:    problem.repaired,
+			Error:       problem.err,
+		})
+	}
+
+	return res
+}
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+)
+
+// Unencrypted content is stored once under its cid in blobsDir and every
+// filename uploaded with that content refers to the blob through the index.
+// Encrypted files can't be shared, their ciphertext is unique, so they're
+// still written under their own (proper) filename.
+const blobsDir = ".blobs"
+
+func isBlobPath(storagePath string) bool {
+	return strings.HasPrefix(storagePath, blobsDir+"/")
+}
+
+// resolveStoragePath returns where the content for an uploaded filename is
+// stored, relative to BasePath, or errs.ErrReservedFilename like
+// getProperFilename.
+func (h *Handler) resolveStoragePath(filename string) (string, error) {
+	err := checkFilename(filename)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := h.index.Get(filename)
+	if err == nil && record.StoragePath != "" {
+		return record.StoragePath, nil
+	}
+
+	return h.getProperFilename(filename)
+}
+
+// storeFile writes fileData for meta.Filename, replacing whatever was stored
+// under that name before. Concurrent writes of the same filename are
+// serialized; different filenames only wait on each other while touching
+// the same stored content.
+func (h *Handler) storeFile(fileData []byte, encryptionSecret string, meta *fileMeta) error {
+	h.fileLocks.Lock(meta.Filename)
+	defer h.fileLocks.Unlock(meta.Filename)
+
+	properFilename, err := h.getProperFilename(meta.Filename)
+	if err != nil {
+		return err
+	}
+
+	fullFilePath := h.makeFullFilePath(properFilename)
+	err = h.createDirectories(properFilename)
+	if err != nil {
+		return err
+	}
+
+	previous, previousCid := "", ""
+	record, err := h.index.Get(meta.Filename)
+	if err == nil {
+		previous, previousCid = record.StoragePath, record.Cid
+	}
+
+	storagePath := properFilename
+	if encryptionSecret == "" {
+		key, err := helper.CalculateCid(fileData)
+		if err != nil {
+			return err
+		}
+		storagePath = fmt.Sprintf("%s/%s", blobsDir, key.String())
+	}
+	meta.StoragePath = storagePath
+	record = h.makeIndexRecord(meta, storagePath, fileData)
+
+	if !isBlobPath(storagePath) && h.tryEncryptFile(&fileData, encryptionSecret) != nil {
+		return errs.ErrBadEncryptionSecret
+	}
+	if meta.Encrypted {
+		meta.Checksum = checksum(fileData)
+		record.Checksum = meta.Checksum
+	}
+
+	err = h.replaceProperFile(properFilename, fileData, isBlobPath(storagePath))
+	if err != nil {
+		return err
+	}
+
+	h.storageLocks.Lock(storagePath)
+	if isBlobPath(storagePath) {
+		err = h.writeBlob(fileData, storagePath)
+	}
+	if err == nil {
+		err = h.writeMetaFile(fullFilePath, meta)
+	}
+	if err == nil {
+		err = h.inheritThumbnails(record)
+	}
+	if err == nil {
+		err = h.index.Put(record)
+	}
+	h.storageLocks.Unlock(storagePath)
+	if err != nil {
+		return err
+	}
+
+	// the replaced content may have been the last use of its pin
+	if previousCid != meta.Cid {
+		err = h.releasePin(previousCid, meta.Filename, true)
+		if err != nil {
+			fmt.Printf("Couldn't unpin cid %s: %s\n", previousCid, err)
+		}
+	}
+
+	if isBlobPath(previous) && previous != storagePath {
+		_, err = h.releaseBlob(previous)
+		return err
+	}
+
+	return nil
+}
+
+// inheritThumbnails gives a record of content that's already stored the
+// thumbnails made for it so far. Callers must hold the storage lock for
+// record's storage path.
+func (h *Handler) inheritThumbnails(record *index.Record) error {
+	filenames, err := h.index.References(record.StoragePath)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if filename == record.Filename {
+			continue
+		}
+		other, err := h.index.Get(filename)
+		if err == errs.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		record.Thumbnails = other.Thumbnails
+		return nil
+	}
+
+	return nil
+}
+
+// replaceProperFile drops the file stored under properFilename along with
+// its thumbnails, and writes fileData in its place unless the content lives
+// in a blob.
+func (h *Handler) replaceProperFile(properFilename string, fileData []byte, blob bool) error {
+	h.storageLocks.Lock(properFilename)
+	defer h.storageLocks.Unlock(properFilename)
+
+	fullFilePath := h.makeFullFilePath(properFilename)
+
+	// delete files from dep file including itself
+	err := h.deleteDepFiles(fullFilePath)
+	if err != nil {
+		return err
+	}
+
+	if blob {
+		err = os.Remove(fullFilePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return helper.WriteFileAtomic(fullFilePath, fileData, 0600)
+}
+
+// writeBlob stores fileData at storagePath unless an identical upload
+// already did. Callers must hold the storage lock for storagePath.
+func (h *Handler) writeBlob(fileData []byte, storagePath string) error {
+	blobFullPath := h.makeFullFilePath(storagePath)
+	_, err := os.Stat(blobFullPath)
+	if err == nil {
+		return nil
+	}
+
+	err = h.createDirectories(storagePath)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(blobFullPath, fileData, 0600)
+}
+
+// releaseBlob deletes a blob and its thumbnails once no filename refers to
+// it anymore, and reports whether it did.
+func (h *Handler) releaseBlob(storagePath string) (bool, error) {
+	h.storageLocks.Lock(storagePath)
+	defer h.storageLocks.Unlock(storagePath)
+
+	refs, err := h.index.CountReferences(storagePath)
+	if err != nil || refs > 0 {
+		return false, err
+	}
+
+	blobFullPath := h.makeFullFilePath(storagePath)
+	err = h.deleteDepFiles(blobFullPath)
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Remove(blobFullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
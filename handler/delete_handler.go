@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/request"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func (h *Handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		h.deleteFile(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+func (h *Handler) deleteImage(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	// filename
+	filename, err := request.ParseFilenameFromUrl(r)
+	if err != nil {
+		response.SendBadRequest(w, "filename")
+		return
+	}
+
+	h.deleteStoredFile(w, r, filename)
+}
+
+func (h *Handler) deleteFile(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	// filename
+	filename, err := request.ParseFilenameFromFilesUrl(r)
+	if err != nil {
+		response.SendBadRequest(w, "filename")
+		return
+	}
+
+	h.deleteStoredFile(w, r, filename)
+}
+
+// deleteStoredFile removes an original along with its thumbnails, deps and
+// meta files, and revokes every link issued for any of them. Deduplicated
+// content is only removed once no other filename refers to it.
+func (h *Handler) deleteStoredFile(w http.ResponseWriter, r *http.Request, filename string) {
+	// optional queries
+	unpin := request.ParseUnpin(r)
+
+	h.fileLocks.Lock(filename)
+	defer h.fileLocks.Unlock(filename)
+
+	properFilename, err := h.getProperFilename(filename)
+	if err != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+	fullFilePath := h.makeFullFilePath(properFilename)
+	storagePath, err := h.resolveStoragePath(filename)
+	if err != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+	storageFullPath := h.makeFullFilePath(storagePath)
+	_, err = os.Stat(storageFullPath)
+	if err != nil {
+		response.SendCouldntFindImage(w, err)
+		return
+	}
+
+	cid := ""
+	meta, err := h.readMetaFile(fullFilePath)
+	if err == nil {
+		cid = meta.Cid
+	}
+
+	// revoke before deleting so no link can race the removal
+	revoked := []string{filename, properFilename}
+	if !isBlobPath(storagePath) {
+		for _, dep := range h.readDepsFile(fullFilePath) {
+			revoked = append(revoked, strings.TrimPrefix(dep, h.BasePath+"/"))
+		}
+	}
+	err = h.revocations.revoke(revoked...)
+	if err != nil {
+		response.SendError(w, 500, "Could not revoke links", err)
+		return
+	}
+
+	if !isBlobPath(storagePath) {
+		h.storageLocks.Lock(properFilename)
+		err = h.deleteDepFiles(fullFilePath)
+		if err != nil {
+			h.storageLocks.Unlock(properFilename)
+			response.SendError(w, 500, "Could not delete thumbnails", err)
+			return
+		}
+
+		err = os.Remove(fullFilePath)
+		h.storageLocks.Unlock(properFilename)
+		if err != nil {
+			response.SendError(w, 500, "Could not delete file", err)
+			return
+		}
+	}
+
+	err = os.Remove(fmt.Sprintf("%s_meta", fullFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		response.SendError(w, 500, "Could not delete meta file", err)
+		return
+	}
+
+	err = h.index.Delete(filename)
+	if err != nil {
+		response.SendError(w, 500, "Could not remove file from index", err)
+		return
+	}
+
+	if isBlobPath(storagePath) {
+		_, err = h.releaseBlob(storagePath)
+		if err != nil {
+			response.SendError(w, 500, "Could not release file content", err)
+			return
+		}
+	}
+
+	// the file is gone either way, a pin that couldn't be removed stays
+	// listed under /ipfs/pins
+	err = h.releasePin(cid, filename, unpin)
+	if err != nil {
+		fmt.Printf("Couldn't unpin cid %s: %s\n", cid, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,19 +1,26 @@
 package handler
 
 import (
-	"fmt"
 	"net/http"
 
+	"github.com/ipfs/go-cid"
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
 	"github.com/sealsurlaw/gouvre/request"
 	"github.com/sealsurlaw/gouvre/response"
 )
 
 func (h *Handler) DownloadImage(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet && h.isInfoRequest(r) {
+		h.getImageInfo(w, r)
+		return
+	} else if r.Method == http.MethodGet {
 		h.downloadImage(w, r)
 		return
+	} else if r.Method == http.MethodDelete {
+		h.deleteImage(w, r)
+		return
 	} else {
 		response.SendMethodNotFound(w)
 		return
@@ -38,11 +45,50 @@ func (h *Handler) downloadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /images/cid/{cid} serves the stored file whose content has cid
+	if record := h.findByCidFilename(filename); record != nil {
+		filename = record.Filename
+	}
+
+	h.sendImage(w, r, filename)
+}
+
+// findByCidFilename returns the record of the file a cid/{cid} filename
+// refers to. It's nil when the rest isn't a cid or no file in the index has
+// it, so files stored under a cid/ folder are still served by name.
+func (h *Handler) findByCidFilename(filename string) *index.Record {
+	c, err := request.ParseCidFromFilename(filename)
+	if err != nil {
+		return nil
+	}
+
+	// cids are stored as CIDv1, which every CIDv0 has an equivalent of
+	if c.Version() == 0 {
+		c = cid.NewCidV1(c.Type(), c.Hash())
+	}
+
+	record, err := h.index.FindByCid(c.String())
+	if err != nil {
+		return nil
+	}
+
+	return record
+}
+
+// sendImage sends the original stored for filename, or a thumbnail of it
+// when a resolution is asked for.
+func (h *Handler) sendImage(w http.ResponseWriter, r *http.Request, filename string) {
 	// optional queries
 	square := request.ParseSquare(r)
 	resolution := request.ParseResolutionFromQuery(r)
 	encryptionSecret := request.ParseEncryptionSecretFromQuery(r)
 
+	storagePath, err := h.resolveStoragePath(filename)
+	if err != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+
 	var properFilename string
 	if resolution != nil {
 		thumbnailParameters := &ThumbnailParameters{filename, *resolution, square, encryptionSecret}
@@ -50,7 +96,7 @@ func (h *Handler) downloadImage(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			// Bypass thumbnail creation for Gifs
 			if err == errs.ErrGif {
-				thumbnailFilename = h.getProperFilename(filename)
+				thumbnailFilename = storagePath
 			} else {
 				response.SendError(w, 500, "Couldn't check/create thumbnail file.", err)
 				return
@@ -58,7 +104,7 @@ func (h *Handler) downloadImage(w http.ResponseWriter, r *http.Request) {
 		}
 		properFilename = thumbnailFilename
 	} else {
-		properFilename = h.getProperFilename(filename)
+		properFilename = storagePath
 	}
 
 	// open file
@@ -73,10 +119,8 @@ func (h *Handler) downloadImage(w http.ResponseWriter, r *http.Request) {
 	// For gif thumbnails, abort and give full version
 	// Gif thumbnails currently do not support animations
 	contentType := http.DetectContentType(fileData)
-	fmt.Println(contentType)
 	if contentType == "image/gif" && resolution != nil {
-		properFilename = h.getProperFilename(filename)
-		fullFilePath = h.makeFullFilePath(properFilename)
+		fullFilePath = h.makeFullFilePath(storagePath)
 		fileData, err = helper.OpenFile(fullFilePath)
 		if err != nil {
 			response.SendCouldntFindImage(w, err)
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/helper"
+)
+
+func TestDownloadImageByCid(t *testing.T) {
+	s := newTestServer(t, nil)
+	photo := testPng(t, 64, 64)
+	uploaded := s.uploadFile(t, "photo.png", photo)
+	// files stored under a cid/ folder
+	s.uploadFile(t, "cid/readme.txt", []byte("not a cid"))
+	unknown, err := helper.CalculateCid([]byte("never uploaded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.uploadFile(t, "cid/"+unknown.String(), []byte("named like a cid"))
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   []byte
+		wantWidth  int
+	}{
+		{
+			name:       "by cid",
+			path:       "/images/cid/" + uploaded.Cid,
+			wantStatus: http.StatusOK,
+			wantBody:   photo,
+		},
+		{
+			name:       "thumbnail by cid",
+			path:       "/images/cid/" + uploaded.Cid + "?resolution=32",
+			wantStatus: http.StatusOK,
+			wantWidth:  32,
+		},
+		{
+			name:       "file under cid/",
+			path:       "/images/cid/readme.txt",
+			wantStatus: http.StatusOK,
+			wantBody:   []byte("not a cid"),
+		},
+		{
+			name:       "file named like a cid that isn't in the index",
+			path:       "/images/cid/" + unknown.String(),
+			wantStatus: http.StatusOK,
+			wantBody:   []byte("named like a cid"),
+		},
+		{
+			name:       "unknown cid",
+			path:       "/images/cid/bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.do(t, testRequest{path: tt.path, noAuth: true})
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantBody != nil && !bytes.Equal([]byte(body), tt.wantBody) {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if tt.wantWidth != 0 {
+				img, _, err := image.DecodeConfig(bytes.NewReader([]byte(body)))
+				if err != nil || img.Width != tt.wantWidth {
+					t.Errorf("thumbnail is %+v (%v), want %d wide", img, err, tt.wantWidth)
+				}
+			}
+		})
+	}
+}
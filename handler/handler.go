@@ -9,41 +9,143 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/sealsurlaw/gouvre/config"
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+	"github.com/sealsurlaw/gouvre/ipfs"
 	"github.com/sealsurlaw/gouvre/token"
+	"golang.org/x/sync/singleflight"
 )
 
+// stateDir holds the server's own files in BasePath: the index, the job
+// journal, the revocation list and the pins. Like blobsDir it can't be
+// reached through a filename.
+const stateDir = ".gouvre"
+
 type Handler struct {
-	BaseUrl                string
-	BasePath               string
-	tokenizer              *token.Tokenizer
+	BaseUrl               string
+	BasePath              string
+	tokenizer             *token.Tokenizer
+	hashFilename          bool
+	pinToIpfs             bool
+	cidLayout             string
+	ipfs                  *ipfs.Client
+	ipfsConfig            config.IpfsConfig
+	singleUseUploadTokens map[string]bool
+	uploadTokensMu        sync.Mutex
+	revocations           *revocationList
+	pins                  *pinRegistry
+	remotePins            *remotePinQueue
+	fileLocks             *keyedMutex
+	storageLocks          *keyedMutex
+	thumbnailFlight       singleflight.Group
+	decodeSlots           chan struct{}
+	jobs                  *jobQueue
+	index                 index.Index
+	indexConfig           config.IndexConfig
+	janitorMu             sync.Mutex
+	lastJanitorRun        *janitorRun
+	scrubMu               sync.Mutex
+	lastScrubRun          *scrubRun
+
+	// settings that can be swapped at runtime by Reload
+	settingsMu             sync.RWMutex
 	thumbnailQuality       int
-	hashFilename           bool
-	pinToIpfs              bool
+	batchParallelism       int
 	whitelistedTokens      []string
 	whitelistedIpAddresses []string
-	singleUseUploadTokens  map[string]bool
+	metadataPolicy         *config.MetadataPolicy
+	thumbnailCache         *config.ThumbnailCache
+	scrubber               *config.Scrubber
 }
 
-func NewHandler(cfg *config.Config) *Handler {
+func NewHandler(cfg *config.Config, ipfsClient *ipfs.Client) *Handler {
 	tokenizer, err := token.NewTokenizer(cfg.EncryptionSecret)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &Handler{
+	basePath := cfg.BasePath
+	statePath := fmt.Sprintf("%s/%s", basePath, stateDir)
+	err = os.MkdirAll(statePath, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	idx, err := index.Open(cfg.Index.Driver, cfg.Index.Dsn, statePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jobs, err := newJobQueue(statePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	h := &Handler{
 		BaseUrl:                getBaseUrl(cfg),
-		BasePath:               getBasePath(cfg),
+		BasePath:               basePath,
 		tokenizer:              tokenizer,
 		thumbnailQuality:       cfg.ThumbnailQuality,
+		batchParallelism:       cfg.BatchParallelism,
 		hashFilename:           cfg.HashFilename,
 		pinToIpfs:              cfg.PinToIpfs,
+		cidLayout:              cfg.CidLayout,
+		ipfs:                   ipfsClient,
+		ipfsConfig:             *cfg.Ipfs,
 		whitelistedTokens:      cfg.WhitelistedTokens,
 		whitelistedIpAddresses: cfg.WhitelistedIpAddresses,
+		metadataPolicy:         cfg.MetadataPolicy,
+		thumbnailCache:         cfg.ThumbnailCache,
+		scrubber:               cfg.Scrubber,
 		singleUseUploadTokens:  make(map[string]bool),
+		revocations:            newRevocationList(statePath),
+		pins:                   newPinRegistry(statePath),
+		remotePins:             newRemotePinQueue(statePath, newRemoteClients(cfg.Ipfs)),
+		fileLocks:              newKeyedMutex(),
+		storageLocks:           newKeyedMutex(),
+		decodeSlots:            make(chan struct{}, cfg.ThumbnailWorkers),
+		jobs:                   jobs,
+		index:                  idx,
+		indexConfig:            *cfg.Index,
+	}
+
+	if idx.Len() == 0 {
+		err = h.rebuildIndex()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// files pinned before pins were tracked
+	if h.pinToIpfs && !h.pins.exists() {
+		records, _, err := idx.List(&index.ListOptions{Sort: index.SortUploadedAt})
+		if err == nil {
+			err = h.pins.seed(records)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
+	if h.pinToIpfs {
+		err = h.remotePins.sync(h.pins.list())
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return h
+}
+
+func newRemoteClients(ipfsConfig *config.IpfsConfig) []*ipfs.RemoteClient {
+	clients := []*ipfs.RemoteClient{}
+	for _, service := range ipfsConfig.RemotePinning {
+		clients = append(clients, ipfs.NewRemoteClient(service.Name, service.Endpoint, service.Token, ipfsConfig.TimeoutDuration()))
+	}
+
+	return clients
 }
 
 func getBaseUrl(cfg *config.Config) string {
@@ -55,22 +157,12 @@ func getBaseUrl(cfg *config.Config) string {
 	return baseUrl
 }
 
-func getBasePath(cfg *config.Config) string {
-	basePath := cfg.BasePath
-	if basePath == "" {
-		bp, err := os.MkdirTemp("/tmp", "imageserver.*")
-		if err != nil {
-			log.Fatal("Couldn't create tmp directory")
-		}
-		basePath = bp
-	}
-
-	return basePath
-}
-
 func (h *Handler) checkFileExists(filename string, encryptionSecret string) (string, error) {
 	// open file to make sure it exists
-	filename = h.getProperFilename(filename)
+	filename, err := h.resolveStoragePath(filename)
+	if err != nil {
+		return "", err
+	}
 	fullFilePath := h.makeFullFilePath(filename)
 	fileData, err := helper.OpenFile(fullFilePath)
 	if err != nil {
@@ -84,14 +176,37 @@ func (h *Handler) checkFileExists(filename string, encryptionSecret string) (str
 	return filename, nil
 }
 
+// isStoredFile reports whether an original is stored for filename.
+func (h *Handler) isStoredFile(filename string) bool {
+	storagePath, err := h.resolveStoragePath(filename)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(h.makeFullFilePath(storagePath))
+	return err == nil
+}
+
 func (h *Handler) checkOrCreateThumbnailFile(tp *ThumbnailParameters) (string, error) {
 	// open file to make sure it exists
-	thumbnailFilename := h.getThumbnailFilename(tp)
+	thumbnailFilename, err := h.getThumbnailFilename(tp)
+	if err != nil {
+		return "", err
+	}
 	thumbnailfullFilePath := h.makeFullFilePath(thumbnailFilename)
 	fileData, err := helper.OpenFile(thumbnailfullFilePath)
 	if err != nil {
-		// if not found, attempt to make it
-		err = h.createThumbnail(tp)
+		// if not found, attempt to make it. Concurrent requests for the same
+		// thumbnail wait on a single attempt instead of each decoding the
+		// original. The secret is part of the key so a request with a wrong
+		// one can't fail the others.
+		flightKey := fmt.Sprintf("%s %s", thumbnailFilename, checksum([]byte(tp.EncryptionSecret)))
+		_, err, _ = h.thumbnailFlight.Do(flightKey, func() (interface{}, error) {
+			if _, err := os.Stat(thumbnailfullFilePath); err == nil {
+				return nil, nil
+			}
+			return nil, h.createThumbnail(tp)
+		})
 		if err != nil {
 			return "", err
 		}
@@ -100,6 +215,8 @@ func (h *Handler) checkOrCreateThumbnailFile(tp *ThumbnailParameters) (string, e
 		if err != nil {
 			return "", err
 		}
+	} else {
+		h.touchThumbnail(thumbnailFilename)
 	}
 
 	if h.tryDecryptFile(&fileData, tp.EncryptionSecret) != nil {
@@ -109,6 +226,38 @@ func (h *Handler) checkOrCreateThumbnailFile(tp *ThumbnailParameters) (string, e
 	return thumbnailFilename, nil
 }
 
+// resolveTokenFile returns the storage path a link token points at,
+// regenerating the thumbnail it refers to if it has been removed. Tokens
+// issued before links referred to the uploaded filename hold the storage
+// path itself.
+func (h *Handler) resolveTokenFile(tokenData *token.TokenData, encryptionSecret string) (string, error) {
+	if !tokenData.Original {
+		return tokenData.Filename, nil
+	}
+	if tokenData.Resolution == 0 {
+		return h.resolveStoragePath(tokenData.Filename)
+	}
+
+	tp := &ThumbnailParameters{tokenData.Filename, tokenData.Resolution, tokenData.Cropped, encryptionSecret}
+	thumbnailFilename, err := h.getThumbnailFilename(tp)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(h.makeFullFilePath(thumbnailFilename))
+	if err == nil {
+		h.touchThumbnail(thumbnailFilename)
+		return thumbnailFilename, nil
+	}
+
+	thumbnailFilename, err = h.checkOrCreateThumbnailFile(tp)
+	// Bypass thumbnail creation for Gifs
+	if err == errs.ErrGif {
+		return h.resolveStoragePath(tokenData.Filename)
+	}
+
+	return thumbnailFilename, err
+}
+
 func (h *Handler) createDirectories(filename string) error {
 	// check if directories need to be created
 	if strings.Contains(filename, "/") {
@@ -131,82 +280,117 @@ func (h *Handler) createDirectories(filename string) error {
 }
 
 func (h *Handler) createThumbnail(tp *ThumbnailParameters) error {
-	// open file
-	fn := h.getProperFilename(tp.Filename)
-	fullFilePath := h.makeFullFilePath(fn)
-	fileData, err := helper.OpenFile(fullFilePath)
+	thumbData, storagePath, err := h.decodeThumbnail(tp)
 	if err != nil {
 		return err
 	}
 
-	if h.tryDecryptFile(&fileData, tp.EncryptionSecret) != nil {
-		return errs.ErrBadEncryptionSecret
-	}
-
-	contentType := http.DetectContentType(fileData)
-	if contentType == "image/gif" {
-		return errs.ErrGif
-	}
-
-	// create thumbnail
-	thumbData, err := helper.CreateThumbnail(
-		fileData,
-		tp.Resolution,
-		tp.Cropped,
-		h.thumbnailQuality,
-	)
+	thumbnailFilename, err := h.getThumbnailFilename(tp)
 	if err != nil {
 		return err
 	}
-
-	thumbnailFilename := h.getThumbnailFilename(tp)
 	thumbnailfullFilePath := h.makeFullFilePath(thumbnailFilename)
 
-	// update the deps file
-	err = h.updateDepsFile(fullFilePath, thumbnailfullFilePath)
+	err = h.createDirectories(thumbnailFilename)
 	if err != nil {
 		return err
 	}
 
-	err = h.createDirectories(thumbnailFilename)
+	if h.tryEncryptFile(&thumbData, tp.EncryptionSecret) != nil {
+		return errs.ErrBadEncryptionSecret
+	}
+
+	err = helper.WriteFileAtomic(thumbnailfullFilePath, thumbData, 0600)
 	if err != nil {
 		return err
 	}
 
-	if h.tryEncryptFile(&thumbData, tp.EncryptionSecret) != nil {
-		return errs.ErrBadEncryptionSecret
+	// update the deps file once the thumbnail exists, so the janitor never
+	// sees a dep without its file
+	err = h.updateDepsFile(storagePath, thumbnailfullFilePath)
+	if err != nil {
+		return err
 	}
 
-	err = os.WriteFile(thumbnailfullFilePath, thumbData, 0600)
+	// deduplicated content shares its thumbnails with every filename
+	filenames, err := h.index.References(storagePath)
 	if err != nil {
 		return err
 	}
+	for _, filename := range filenames {
+		err = h.index.Update(filename, func(record *index.Record) error {
+			record.AddThumbnail(&index.Thumbnail{
+				Resolution:  tp.Resolution,
+				Cropped:     tp.Cropped,
+				StoragePath: thumbnailFilename,
+			})
+			return nil
+		})
+		if err != nil && err != errs.ErrNotFound {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (h *Handler) deleteDepFiles(fullFilePath string) error {
-	depfullFilePath := fmt.Sprintf("%s_deps", fullFilePath)
-	depFile, err := os.Open(depfullFilePath)
-	if err != nil {
-		return nil
+// decodeThumbnail scales the original down to the requested thumbnail and
+// returns it along with the storage path of the original. At most
+// thumbnailWorkers originals are decoded at once; the rest wait their turn.
+func (h *Handler) decodeThumbnail(tp *ThumbnailParameters) ([]byte, string, error) {
+	h.decodeSlots <- struct{}{}
+	defer func() { <-h.decodeSlots }()
+
+	record, err := h.index.Get(tp.Filename)
+	if err == nil && record.Encrypted && tp.EncryptionSecret == "" {
+		return nil, "", errs.ErrBadEncryptionSecret
 	}
 
-	scanner := bufio.NewScanner(depFile)
-	for scanner.Scan() {
-		err = os.Remove(scanner.Text())
-		if err != nil {
-			return nil
-		}
+	// open file
+	storagePath, err := h.resolveStoragePath(tp.Filename)
+	if err != nil {
+		return nil, "", err
 	}
-	err = depFile.Close()
+	fileData, err := helper.OpenFile(h.makeFullFilePath(storagePath))
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	err = os.Remove(depfullFilePath)
+	if h.tryDecryptFile(&fileData, tp.EncryptionSecret) != nil {
+		return nil, "", errs.ErrBadEncryptionSecret
+	}
+
+	contentType := http.DetectContentType(fileData)
+	if contentType == "image/gif" {
+		return nil, "", errs.ErrGif
+	}
+
+	// create thumbnail
+	thumbData, err := helper.CreateThumbnail(
+		fileData,
+		tp.Resolution,
+		tp.Cropped,
+		h.getThumbnailQuality(),
+	)
 	if err != nil {
-		return nil
+		return nil, "", err
+	}
+
+	return thumbData, storagePath, nil
+}
+
+func (h *Handler) deleteDepFiles(fullFilePath string) error {
+	depfullFilePath := fmt.Sprintf("%s_deps", fullFilePath)
+	for _, dep := range h.readDepsFile(fullFilePath) {
+		err := os.Remove(dep)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := os.Remove(depfullFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
 	return nil
@@ -246,24 +430,59 @@ func (h *Handler) tryEncryptFile(fileData *[]byte, encryptionSecret string) erro
 	return nil
 }
 
-func (h *Handler) getProperFilename(filename string) string {
+// getProperFilename returns where filename is stored relative to
+// BasePath, or errs.ErrReservedFilename if it could name one of the
+// server's own files.
+func (h *Handler) getProperFilename(filename string) (string, error) {
+	err := checkFilename(filename)
+	if err != nil {
+		return "", err
+	}
+
 	if h.hashFilename {
 		filename = helper.CalculateHash(filename)
 		filename = fmt.Sprintf("%s/%s/%s", string(filename[0]), string(filename[1]), filename)
 	}
 
-	return filename
+	return filename, nil
 }
 
-func (h *Handler) getThumbnailFilename(tp *ThumbnailParameters) string {
+// checkFilename refuses filenames that could reach what the server keeps
+// next to the uploads: anything under a directory starting with a dot,
+// such as stateDir and blobsDir, and the meta and deps files of originals.
+func checkFilename(filename string) error {
+	for _, part := range strings.Split(filename, "/") {
+		if strings.HasPrefix(part, ".") {
+			return errs.ErrReservedFilename
+		}
+	}
+	if strings.HasSuffix(filename, "_meta") || strings.HasSuffix(filename, "_deps") {
+		return errs.ErrReservedFilename
+	}
+
+	return nil
+}
+
+func (h *Handler) getThumbnailFilename(tp *ThumbnailParameters) (string, error) {
 	filename := tp.Filename
 	var thumbnailFilename string
-	if h.hashFilename {
+
+	// thumbnails of deduplicated content are shared by every filename
+	storagePath, err := h.resolveStoragePath(filename)
+	if err != nil {
+		return "", err
+	}
+	if isBlobPath(storagePath) {
+		thumbnailFilename = fmt.Sprintf("%s_%d", storagePath, tp.Resolution)
+		if tp.Cropped {
+			thumbnailFilename += "_crop"
+		}
+	} else if h.hashFilename {
 		filename += strconv.Itoa(tp.Resolution)
 		if tp.Cropped {
 			filename += "crop"
 		}
-		thumbnailFilename = h.getProperFilename(filename)
+		return h.getProperFilename(filename)
 	} else {
 		thumbnailFilename = fmt.Sprintf("%s_%d", filename, tp.Resolution)
 		if tp.Cropped {
@@ -271,10 +490,45 @@ func (h *Handler) getThumbnailFilename(tp *ThumbnailParameters) string {
 		}
 	}
 
-	return thumbnailFilename
+	return thumbnailFilename, nil
+}
+
+func (h *Handler) getThumbnailQuality() int {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
+	return h.thumbnailQuality
+}
+
+func (h *Handler) getBatchParallelism() int {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
+	return h.batchParallelism
+}
+
+// stripMetadata applies the configured metadata policy for the file's format.
+func (h *Handler) stripMetadata(fileData []byte) ([]byte, error) {
+	format := helper.MetadataFormat(http.DetectContentType(fileData))
+	if format == "" {
+		return fileData, nil
+	}
+
+	h.settingsMu.RLock()
+	keep := h.metadataPolicy.KeepFor(format)
+	h.settingsMu.RUnlock()
+
+	if keep == nil {
+		return fileData, nil
+	}
+
+	return helper.StripMetadata(fileData, keep)
 }
 
 func (h *Handler) hasWhitelistedIpAddress(r *http.Request) bool {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
 	ip := helper.GetIpAddress(r)
 	for _, ipAddr := range h.whitelistedIpAddresses {
 		if ipAddr == "*" {
@@ -292,6 +546,9 @@ func (h *Handler) hasWhitelistedIpAddress(r *http.Request) bool {
 }
 
 func (h *Handler) hasWhitelistedToken(r *http.Request) bool {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
 	// If empty, block
 	if len(h.whitelistedTokens) == 0 {
 		return false
@@ -326,6 +583,27 @@ func (h *Handler) hasWhitelistedToken(r *http.Request) bool {
 	return auth
 }
 
+func (h *Handler) addUploadToken(token string) {
+	h.uploadTokensMu.Lock()
+	defer h.uploadTokensMu.Unlock()
+
+	h.singleUseUploadTokens[token] = true
+}
+
+// takeUploadToken uses up a single-use upload token and reports whether it
+// was still valid.
+func (h *Handler) takeUploadToken(token string) bool {
+	h.uploadTokensMu.Lock()
+	defer h.uploadTokensMu.Unlock()
+
+	if !h.singleUseUploadTokens[token] {
+		return false
+	}
+	delete(h.singleUseUploadTokens, token)
+
+	return true
+}
+
 func (h *Handler) makeFullFilePath(filename string) string {
 	return fmt.Sprintf("%s/%s", h.BasePath, filename)
 }
@@ -338,7 +616,17 @@ func (h *Handler) makeUploadTokenUrl(token string) string {
 	return fmt.Sprintf("%s/images/uploads/%s", h.BaseUrl, token)
 }
 
-func (h *Handler) updateDepsFile(fullFilePath, thumbnailfullFilePath string) error {
+func (h *Handler) updateDepsFile(storagePath, thumbnailfullFilePath string) error {
+	h.storageLocks.Lock(storagePath)
+	defer h.storageLocks.Unlock(storagePath)
+
+	fullFilePath := h.makeFullFilePath(storagePath)
+	for _, dep := range h.readDepsFile(fullFilePath) {
+		if dep == thumbnailfullFilePath {
+			return nil
+		}
+	}
+
 	depsFilename := fmt.Sprintf("%s_deps", fullFilePath)
 	depsFile, err := os.OpenFile(depsFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
@@ -361,57 +649,39 @@ func (h *Handler) updateDepsFile(fullFilePath, thumbnailfullFilePath string) err
 	return nil
 }
 
-func (h *Handler) writeFile(fileData []byte, filename string, encryptionSecret string) error {
-	filename = h.getProperFilename(filename)
-	err := h.createDirectories(filename)
+func (h *Handler) readDepsFile(fullFilePath string) []string {
+	depsFilename := fmt.Sprintf("%s_deps", fullFilePath)
+	depsFile, err := os.Open(depsFilename)
 	if err != nil {
-		return err
-	}
-
-	fullFilePath := h.makeFullFilePath(filename)
-
-	if h.tryEncryptFile(&fileData, encryptionSecret) != nil {
-		return err
+		return []string{}
 	}
+	defer depsFile.Close()
 
-	// write file
-	err = os.WriteFile(fullFilePath, fileData, 0600)
-	if err != nil {
-		return err
+	seen := make(map[string]bool)
+	deps := []string{}
+	scanner := bufio.NewScanner(depsFile)
+	for scanner.Scan() {
+		dep := scanner.Text()
+		if dep == "" || seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		deps = append(deps, dep)
 	}
 
-	return nil
+	return deps
 }
 
-func (h *Handler) writeImage(fileData []byte, filename string, encryptionSecret string) error {
-	filename = h.getProperFilename(filename)
-	err := h.createDirectories(filename)
-	if err != nil {
-		return err
-	}
+func (h *Handler) writeFile(fileData []byte, encryptionSecret string, meta *fileMeta) error {
+	return h.storeFile(fileData, encryptionSecret, meta)
+}
 
+func (h *Handler) writeImage(fileData []byte, encryptionSecret string, meta *fileMeta) error {
 	contentType := http.DetectContentType(fileData)
 	if !helper.IsSupportedContentType(contentType) {
 		msg := fmt.Sprintf("Content type %s not supported.", contentType)
 		return fmt.Errorf(msg)
 	}
 
-	fullFilePath := h.makeFullFilePath(filename)
-
-	// delete files from dep file including itself
-	err = h.deleteDepFiles(fullFilePath)
-	if err != nil {
-		return err
-	}
-
-	if h.tryEncryptFile(&fileData, encryptionSecret) != nil {
-		return err
-	}
-
-	err = os.WriteFile(fullFilePath, fileData, 0600)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return h.storeFile(fileData, encryptionSecret, meta)
 }
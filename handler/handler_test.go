@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/config"
+	"github.com/sealsurlaw/gouvre/ipfs"
+	"github.com/sealsurlaw/gouvre/ipfs/ipfstest"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+const testAuthToken = "test-token"
+
+// testServer serves every route of a handler whose node is a fake.
+type testServer struct {
+	*httptest.Server
+	node     *ipfstest.Node
+	h        *Handler
+	basePath string
+}
+
+// newTestServer starts a handler on a fresh basePath. settings are added
+// to the config, replacing the defaults.
+func newTestServer(t *testing.T, settings map[string]interface{}) *testServer {
+	t.Helper()
+
+	return newTestServerAt(t, t.TempDir(), settings)
+}
+
+// newTestServerAt is newTestServer on an existing basePath.
+func newTestServerAt(t *testing.T, basePath string, settings map[string]interface{}) *testServer {
+	t.Helper()
+
+	node := ipfstest.NewNode("Basic dXNlcjpwYXNz")
+	t.Cleanup(node.Close)
+
+	cfgMap := map[string]interface{}{
+		"basePath":          basePath,
+		"encryptionSecret":  "test-secret",
+		"whitelistedTokens": []string{testAuthToken},
+		"ipfs": map[string]interface{}{
+			"apiUrl":     node.URL,
+			"authHeader": "Basic dXNlcjpwYXNz",
+			"retries":    0,
+		},
+	}
+	for name, value := range settings {
+		cfgMap[name] = value
+	}
+	configFile := fmt.Sprintf("%s/config.json", t.TempDir())
+	configData, err := json.Marshal(cfgMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(configFile, configData, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.NewConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ipfsClient := ipfs.NewClient(cfg.Ipfs.ApiUrl, cfg.Ipfs.AuthHeader, cfg.Ipfs.TimeoutDuration(), cfg.Ipfs.Retries)
+	h := NewHandler(cfg, ipfsClient)
+	t.Cleanup(func() { h.index.Close() })
+
+	mux := http.NewServeMux()
+	for pattern, routeHandler := range h.Routes() {
+		mux.HandleFunc(pattern, routeHandler)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &testServer{Server: server, node: node, h: h, basePath: basePath}
+}
+
+type testRequest struct {
+	method  string
+	path    string
+	body    string
+	headers map[string]string
+	noAuth  bool
+}
+
+func (s *testServer) do(t *testing.T, req testRequest) (*http.Response, string) {
+	t.Helper()
+
+	method := req.method
+	if method == "" {
+		method = http.MethodGet
+	}
+	httpReq, err := http.NewRequest(method, s.URL+req.path, strings.NewReader(req.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.noAuth {
+		httpReq.Header.Set("Authorization", "Bearer "+testAuthToken)
+	}
+	for name, value := range req.headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// upload posts fileData to path as a multipart form with the given fields.
+func (s *testServer) upload(t *testing.T, path string, fileData []byte, fields map[string]string) (*http.Response, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		_ = writer.WriteField(name, value)
+	}
+	part, err := writer.CreateFormFile("file", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(fileData)
+	_ = writer.Close()
+
+	return s.do(t, testRequest{
+		method:  http.MethodPost,
+		path:    path,
+		body:    body.String(),
+		headers: map[string]string{"Content-Type": writer.FormDataContentType()},
+	})
+}
+
+// uploadFile stores fileData as filename through /files/upload.
+func (s *testServer) uploadFile(t *testing.T, filename string, fileData []byte) *response.UploadImageResponse {
+	t.Helper()
+
+	resp, body := s.upload(t, "/files/upload", fileData, map[string]string{"filename": filename})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("uploading %s: status = %d, want %d: %s", filename, resp.StatusCode, http.StatusCreated, body)
+	}
+	res := &response.UploadImageResponse{}
+	decode(t, body, res)
+
+	return res
+}
+
+// testPng returns a PNG of width by height pixels.
+func testPng(t *testing.T, width int, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// linkPath returns the path of a link the handler made.
+func (s *testServer) linkPath(url string) string {
+	return strings.TrimPrefix(url, s.h.BaseUrl)
+}
+
+func decode(t *testing.T, body string, v interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal([]byte(body), v)
+	if err != nil {
+		t.Fatalf("couldn't decode %q: %s", body, err)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestReservedFilenames(t *testing.T) {
+	s := newTestServer(t, nil)
+	uploaded := s.uploadFile(t, "notes.txt", []byte("hello, world"))
+	blob := fmt.Sprintf("%s/%s", blobsDir, uploaded.Cid)
+	stateFiles := []string{"index.db", "jobs.journal"}
+
+	tests := []testRequest{
+		{path: "/images/.gouvre/index.db"},
+		{path: "/images/.gouvre/jobs.journal"},
+		{path: "/images/.gouvre/index.db/info"},
+		{path: "/images/" + blob},
+		{path: "/images/notes.txt_meta"},
+		{path: "/images/notes.txt_deps"},
+		{method: http.MethodDelete, path: "/images/.gouvre/revocations.json"},
+		{method: http.MethodDelete, path: "/files/.gouvre/index.db"},
+		{method: http.MethodDelete, path: "/files/notes.txt_meta"},
+		{method: http.MethodPost, path: "/images/links", body: `{"filename": ".gouvre/index.db"}`},
+		{method: http.MethodPost, path: "/images/links/upload", body: `{"filename": ".gouvre/pins.json"}`},
+		{method: http.MethodPost, path: "/images/links/thumbnails", body: `{"filename": "notes.txt_meta", "resolution": 64}`},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.method, tt.path), func(t *testing.T) {
+			resp, body := s.do(t, tt)
+			if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Filename is reserved.") {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, body)
+			}
+		})
+	}
+
+	for _, filename := range []string{".gouvre/pins.json", "dir/.hidden", "notes.txt_meta", "other_deps"} {
+		t.Run("upload "+filename, func(t *testing.T) {
+			resp, body := s.upload(t, "/files/upload", []byte("overwrite"), map[string]string{"filename": filename})
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, body)
+			}
+		})
+	}
+
+	// nothing the server keeps was touched
+	for _, name := range stateFiles {
+		if _, err := os.Stat(fmt.Sprintf("%s/%s/%s", s.basePath, stateDir, name)); err != nil {
+			t.Errorf("state file %s: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/notes.txt_meta", s.basePath)); err != nil {
+		t.Errorf("meta file: %s", err)
+	}
+	resp, body := s.do(t, testRequest{path: "/images/notes.txt"})
+	if resp.StatusCode != http.StatusOK || body != "hello, world" {
+		t.Errorf("GET notes.txt = %d %q, want the upload", resp.StatusCode, body)
+	}
+}
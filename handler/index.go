@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+)
+
+// encryptionOverhead is the nonce and GCM tag added to encrypted files.
+const encryptionOverhead = 12 + 16
+
+func (h *Handler) makeIndexRecord(meta *fileMeta, properFilename string, fileData []byte) *index.Record {
+	record := &index.Record{
+		Filename:    meta.Filename,
+		StoragePath: properFilename,
+		Cid:         meta.Cid,
+		Size:        int64(len(fileData)),
+		Encrypted:   meta.Encrypted,
+		UploaderKey: meta.UploaderKey,
+		UploadedAt:  meta.UploadedAt,
+		UpdatedAt:   meta.UploadedAt,
+	}
+	// don't leak what an encrypted file contains
+	if !meta.Encrypted {
+		record.ContentType = http.DetectContentType(fileData)
+		record.Width, record.Height, _, _ = helper.ImageDimensions(fileData)
+	}
+
+	return record
+}
+
+// rebuildIndex recreates the index from what's stored in BasePath, for
+// stores written before the index existed. Originals with a meta file get
+// their record from it. Older originals, stored before meta files were
+// kept, get one from their content; thumbnails are told apart from them by
+// the deps files listing them.
+func (h *Handler) rebuildIndex() error {
+	metas := []string{}
+	files := []string{}
+	thumbnails := make(map[string]bool)
+	err := filepath.WalkDir(h.BasePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// stateDir, blobsDir and temporary files
+		if path != h.BasePath && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+		case strings.HasSuffix(path, "_meta"):
+			metas = append(metas, path)
+		case strings.HasSuffix(path, "_deps"):
+			for _, dep := range h.readDepsFile(strings.TrimSuffix(path, "_deps")) {
+				thumbnails[dep] = true
+			}
+		default:
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	hasMeta := make(map[string]bool)
+	for _, path := range metas {
+		fullFilePath := strings.TrimSuffix(path, "_meta")
+		hasMeta[fullFilePath] = true
+		meta, err := h.readMetaFile(fullFilePath)
+		if err != nil {
+			fmt.Printf("Skipping unreadable meta file %s: %s\n", path, err)
+			continue
+		}
+
+		record, err := h.makeIndexRecordFromDisk(meta, fullFilePath)
+		if err != nil {
+			fmt.Printf("Skipping %s: %s\n", fullFilePath, err)
+			continue
+		}
+
+		err = h.index.Put(record)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+
+	unnamed := 0
+	for _, fullFilePath := range files {
+		if hasMeta[fullFilePath] || thumbnails[fullFilePath] {
+			continue
+		}
+		// hashed filenames can't be turned back into the uploaded ones
+		if h.hashFilename {
+			unnamed++
+			continue
+		}
+
+		record, err := h.makeIndexRecordFromContent(fullFilePath)
+		if err != nil {
+			fmt.Printf("Skipping %s: %s\n", fullFilePath, err)
+			continue
+		}
+
+		err = h.index.Put(record)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+
+	if count > 0 {
+		fmt.Printf("Rebuilt index with %d files\n", count)
+	}
+	if unnamed > 0 {
+		fmt.Printf("Couldn't index %d files stored under hashed filenames without a meta file\n", unnamed)
+	}
+
+	return nil
+}
+
+func (h *Handler) makeIndexRecordFromDisk(meta *fileMeta, fullFilePath string) (*index.Record, error) {
+	storagePath := strings.TrimPrefix(fullFilePath, h.BasePath+"/")
+	if meta.StoragePath != "" {
+		storagePath = meta.StoragePath
+	}
+
+	file, err := os.Open(h.makeFullFilePath(storagePath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	record := &index.Record{
+		Filename:    meta.Filename,
+		StoragePath: storagePath,
+		Cid:         meta.Cid,
+		Size:        stat.Size(),
+		Encrypted:   meta.Encrypted,
+		Checksum:    meta.Checksum,
+		UploaderKey: meta.UploaderKey,
+		UploadedAt:  meta.UploadedAt,
+		UpdatedAt:   meta.UploadedAt,
+	}
+
+	if meta.Encrypted {
+		record.Size -= encryptionOverhead
+	} else {
+		fileData, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		record.ContentType = http.DetectContentType(fileData)
+		record.Width, record.Height, _, _ = helper.ImageDimensions(fileData)
+	}
+
+	return record, nil
+}
+
+// makeIndexRecordFromContent describes an original stored without a meta
+// file from its content. Encrypted content can't be told apart from other
+// binary content, so the cid and content type of binary files are left
+// unknown.
+func (h *Handler) makeIndexRecordFromContent(fullFilePath string) (*index.Record, error) {
+	stat, err := os.Stat(fullFilePath)
+	if err != nil {
+		return nil, err
+	}
+	fileData, err := os.ReadFile(fullFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	storagePath := strings.TrimPrefix(fullFilePath, h.BasePath+"/")
+	record := &index.Record{
+		Filename:    storagePath,
+		StoragePath: storagePath,
+		Size:        int64(len(fileData)),
+		UploadedAt:  stat.ModTime().UTC(),
+		UpdatedAt:   stat.ModTime().UTC(),
+	}
+
+	contentType := http.DetectContentType(fileData)
+	if contentType == "application/octet-stream" {
+		return record, nil
+	}
+	record.ContentType = contentType
+	record.Width, record.Height, _, _ = helper.ImageDimensions(fileData)
+
+	c, err := helper.CalculateCidWithLayout(fileData, h.uploadCidLayout())
+	if err != nil {
+		return nil, err
+	}
+	record.Cid = c.String()
+
+	return record, nil
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+// writeBaselineStore lays out a basePath the way it was before meta files
+// and the index: originals under their filenames, and thumbnails next to
+// them listed in a deps file.
+func writeBaselineStore(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	basePath := t.TempDir()
+	photo := testPng(t, 64, 48)
+	secret := make([]byte, 256)
+	_, _ = rand.Read(secret)
+	files := map[string][]byte{
+		"photo.png":           photo,
+		"photo.png_32":        testPng(t, 32, 24),
+		"photo.png_32_crop":   testPng(t, 32, 32),
+		"photo.png_deps":      []byte(fmt.Sprintf("%[1]s/photo.png_32\n%[1]s/photo.png_32_crop\n", basePath)),
+		"docs/notes.txt":      []byte("some notes"),
+		"secret.bin":          secret,
+		".photo.png.tmp12345": []byte("left over from a crash"),
+	}
+	for filename, data := range files {
+		fullFilePath := filepath.Join(basePath, filename)
+		err := os.MkdirAll(filepath.Dir(fullFilePath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fullFilePath, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return basePath, photo
+}
+
+func TestRebuildIndexFromBaselineStore(t *testing.T) {
+	basePath, photo := writeBaselineStore(t)
+	s := newTestServerAt(t, basePath, map[string]interface{}{"pinToIpfs": true})
+
+	resp, body := s.do(t, testRequest{path: "/images"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	list := &response.ListImagesResponse{}
+	decode(t, body, list)
+	want := []string{"docs/notes.txt", "photo.png", "secret.bin"}
+	if fmt.Sprint(list.Filenames) != fmt.Sprint(want) {
+		t.Errorf("listed %v, want %v", list.Filenames, want)
+	}
+
+	// pinned as `ipfs add --cid-version=1` did
+	photoCid, err := helper.CalculateCidWithLayout(photo, helper.CidLayoutUnixfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.h.index.Get("photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.StoragePath != "photo.png" || record.Cid != photoCid.String() || record.ContentType != "image/png" ||
+		record.Width != 64 || record.Height != 48 || record.Size != int64(len(photo)) {
+		t.Errorf("photo.png record = %+v, want a 64x48 image/png with cid %s", record, photoCid)
+	}
+
+	// may be encrypted, so there's no telling what was pinned
+	record, err = s.h.index.Get("secret.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Cid != "" || record.ContentType != "" || record.Size != 256 {
+		t.Errorf("secret.bin record = %+v, want 256 bytes with no cid or content type", record)
+	}
+
+	resp, body = s.do(t, testRequest{path: "/images/photo.png/info"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("info status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	info := &response.ImageInfoResponse{}
+	decode(t, body, info)
+	if info.Cid != photoCid.String() || info.Width != 64 {
+		t.Errorf("info = %+v, want width 64 and cid %s", info, photoCid)
+	}
+
+	pins := s.h.pins.list()
+	if len(pins) != 2 {
+		t.Fatalf("%d pins seeded, want 2", len(pins))
+	}
+	if _, ok := s.h.pins.get(photoCid.String()); !ok {
+		t.Errorf("photo.png isn't pinned")
+	}
+}
+
+func TestRebuildIndexSkipsHashedFilenames(t *testing.T) {
+	basePath, _ := writeBaselineStore(t)
+	s := newTestServerAt(t, basePath, map[string]interface{}{"hashFilename": true})
+
+	if n := s.h.index.Len(); n != 0 {
+		t.Errorf("%d files indexed, want 0", n)
+	}
+}
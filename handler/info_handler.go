@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/request"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+// isInfoRequest tells /images/{file}/info from a stored file whose name
+// ends in /info, which is downloaded as usual.
+func (h *Handler) isInfoRequest(r *http.Request) bool {
+	filename, err := request.ParseFilenameFromInfoUrl(r)
+	if err != nil {
+		return false
+	}
+
+	return !h.isStoredFile(filename + "/info")
+}
+
+func (h *Handler) getImageInfo(w http.ResponseWriter, r *http.Request) {
+	// filename
+	filename, err := request.ParseFilenameFromInfoUrl(r)
+	if err != nil {
+		response.SendBadRequest(w, "filename")
+		return
+	}
+
+	// optional queries
+	encryptionSecret := request.ParseEncryptionSecretFromQuery(r)
+
+	properFilename, err := h.getProperFilename(filename)
+	if err != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+	storagePath, err := h.resolveStoragePath(filename)
+	if err != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+	info, err := h.makeImageInfo(properFilename, storagePath, encryptionSecret)
+	if err == errs.ErrBadEncryptionSecret {
+		response.SendError(w, 403, "Bad encryption secret.", err)
+		return
+	} else if err != nil {
+		response.SendCouldntFindImage(w, err)
+		return
+	}
+
+	response.SendJson(w, info, 200)
+}
+
+func (h *Handler) getImageInfoFromTokenLink(w http.ResponseWriter, r *http.Request) {
+	// token
+	token, err := request.ParseTokenFromInfoUrl(r)
+	if err != nil {
+		response.SendBadRequest(w, "token")
+		return
+	}
+
+	tokenData, err := h.tokenizer.ParseTokenData(token)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't parse token.", err)
+		return
+	}
+
+	if h.revocations.isRevoked(tokenData) {
+		response.SendError(w, 410, "Link has been revoked.", errs.ErrTokenRevoked)
+		return
+	}
+
+	secret := tokenData.EncryptionSecret
+	if secret == "" {
+		secret = request.ParseEncryptionSecretFromQuery(r)
+	}
+
+	storagePath, err := h.resolveTokenFile(tokenData, secret)
+	if err == errs.ErrBadEncryptionSecret {
+		response.SendError(w, 403, "Bad encryption secret.", err)
+		return
+	} else if err != nil {
+		response.SendError(w, 500, "Couldn't check/create thumbnail file.", err)
+		return
+	}
+
+	// only originals have a meta file under their own name
+	properFilename := storagePath
+	if tokenData.Original && tokenData.Resolution == 0 {
+		properFilename, err = h.getProperFilename(tokenData.Filename)
+		if err != nil {
+			response.SendReservedFilename(w)
+			return
+		}
+	}
+
+	info, err := h.makeImageInfo(properFilename, storagePath, secret)
+	if err == errs.ErrBadEncryptionSecret {
+		response.SendError(w, 403, "Bad encryption secret.", err)
+		return
+	} else if err != nil {
+		response.SendCouldntFindImage(w, err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	response.SendJson(w, info, 200)
+}
+
+// makeImageInfo describes the file stored at storagePath, with the meta file
+// kept under properFilename. Content details (type, size, dimensions) are
+// only filled in when the file can be read, so an encrypted file asked about
+// without a secret only reports what's in its meta file. A wrong secret is
+// errs.ErrBadEncryptionSecret.
+func (h *Handler) makeImageInfo(properFilename string, storagePath string, encryptionSecret string) (*response.ImageInfoResponse, error) {
+	fullFilePath := h.makeFullFilePath(storagePath)
+	stat, err := os.Stat(fullFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadedAt := stat.ModTime().UTC()
+	info := &response.ImageInfoResponse{
+		UploadedAt: &uploadedAt,
+		Thumbnails: []string{},
+	}
+
+	// files without a meta file may be encrypted, the secret tells
+	meta, err := h.readMetaFile(h.makeFullFilePath(properFilename))
+	if err == nil {
+		info.Cid = meta.Cid
+		info.UploadedAt = &meta.UploadedAt
+		info.Encrypted = meta.Encrypted
+	} else {
+		info.Encrypted = encryptionSecret != ""
+		// indexed from its content when the index was rebuilt
+		if record, err := h.index.Get(properFilename); err == nil {
+			info.Cid = record.Cid
+		}
+	}
+
+	for _, dep := range h.readDepsFile(fullFilePath) {
+		info.Thumbnails = append(info.Thumbnails, strings.TrimPrefix(dep, h.BasePath+"/"))
+	}
+
+	fileData, err := helper.OpenFile(fullFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Encrypted {
+		if encryptionSecret == "" {
+			return info, nil
+		}
+		if h.tryDecryptFile(&fileData, encryptionSecret) != nil {
+			return nil, errs.ErrBadEncryptionSecret
+		}
+	}
+
+	size := len(fileData)
+	info.Size = &size
+	info.ContentType = http.DetectContentType(fileData)
+
+	width, height, orientation, err := helper.ImageDimensions(fileData)
+	if err == nil {
+		info.Width, info.Height, info.Orientation = width, height, orientation
+	}
+
+	return info, nil
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func TestGetImageInfo(t *testing.T) {
+	s := newTestServer(t, nil)
+	uploaded := s.uploadFile(t, "photo.png", testPng(t, 64, 48))
+	// a file whose name ends in /info
+	s.uploadFile(t, "album/info", []byte("a file named info"))
+
+	resp, body := s.do(t, testRequest{
+		method: http.MethodPost,
+		path:   "/images/links",
+		body:   `{"filename": "photo.png"}`,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("link status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	link := &response.GetLinkResponse{}
+	decode(t, body, link)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantInfo   *response.ImageInfoResponse
+		wantBody   string
+	}{
+		{
+			name:       "info",
+			path:       "/images/photo.png/info",
+			wantStatus: http.StatusOK,
+			wantInfo:   &response.ImageInfoResponse{ContentType: "image/png", Width: 64, Height: 48, Cid: uploaded.Cid},
+		},
+		{
+			name:       "token link info",
+			path:       s.linkPath(link.Url) + "/info",
+			wantStatus: http.StatusOK,
+			wantInfo:   &response.ImageInfoResponse{ContentType: "image/png", Width: 64, Height: 48, Cid: uploaded.Cid},
+		},
+		{
+			name:       "file named info",
+			path:       "/images/album/info",
+			wantStatus: http.StatusOK,
+			wantBody:   "a file named info",
+		},
+		{
+			name:       "info of a file named info",
+			path:       "/images/album/info/info",
+			wantStatus: http.StatusOK,
+			wantInfo:   &response.ImageInfoResponse{ContentType: "text/plain; charset=utf-8"},
+		},
+		{
+			name:       "missing file",
+			path:       "/images/missing.png/info",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "query isn't info",
+			path:       "/images/photo.png?info",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.do(t, testRequest{path: tt.path, noAuth: true})
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+			if tt.wantInfo == nil {
+				if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Type") == "application/json" {
+					t.Errorf("got info %s, want the file", body)
+				}
+				return
+			}
+
+			info := &response.ImageInfoResponse{}
+			decode(t, body, info)
+			if info.ContentType != tt.wantInfo.ContentType || info.Width != tt.wantInfo.Width ||
+				info.Height != tt.wantInfo.Height || info.UploadedAt == nil {
+				t.Errorf("info = %s, want %+v", body, tt.wantInfo)
+			}
+			if tt.wantInfo.Cid != "" && info.Cid != tt.wantInfo.Cid {
+				t.Errorf("cid = %s, want %s", info.Cid, tt.wantInfo.Cid)
+			}
+		})
+	}
+}
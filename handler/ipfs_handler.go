@@ -1,17 +1,46 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 
+	"github.com/multiformats/go-multicodec"
 	"github.com/sealsurlaw/gouvre/errs"
-	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/ipfs"
 	"github.com/sealsurlaw/gouvre/request"
 	"github.com/sealsurlaw/gouvre/response"
 )
 
+// IpfsRoutes returns the handlers of the /ipfs/ endpoints by pattern. They
+// only exist with a node to talk to, without pinToIpfs everything under
+// /ipfs/ answers that ipfs isn't enabled.
+func (h *Handler) IpfsRoutes() map[string]http.HandlerFunc {
+	if !h.pinToIpfs {
+		return map[string]http.HandlerFunc{
+			"/ipfs/": func(w http.ResponseWriter, r *http.Request) {
+				response.SendIpfsNotEnabled(w)
+			},
+		}
+	}
+
+	return map[string]http.HandlerFunc{
+		"/ipfs/json":  h.AddJsonToIpfs,
+		"/ipfs/add":   h.AddToIpfs,
+		"/ipfs/pins/": h.IpfsPin,
+		"/ipfs/pins":  h.ListIpfsPins,
+		"/ipfs/":      h.GetIpfsFile,
+	}
+}
+
 func (h *Handler) AddJsonToIpfs(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		h.addJsonToIpfs(w, r)
@@ -22,8 +51,18 @@ func (h *Handler) AddJsonToIpfs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) AddToIpfs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		h.addToIpfs(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
 func (h *Handler) GetIpfsFile(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
 		h.getIpfsFile(w, r)
 		return
 	} else {
@@ -33,10 +72,6 @@ func (h *Handler) GetIpfsFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) addJsonToIpfs(w http.ResponseWriter, r *http.Request) {
-	if !h.pinToIpfs {
-		response.SendError(w, 400, "Ipfs is not enabled.", nil)
-	}
-
 	if !h.hasWhitelistedToken(r) {
 		response.SendInvalidAuthToken(w)
 		return
@@ -60,40 +95,473 @@ func (h *Handler) addJsonToIpfs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cid, err := helper.PinFile(fileData, "")
+	cid, err := h.ipfs.Add(fileData, "")
 	if err != nil {
 		response.SendError(w, 500, "Could not pin file to IPFS", err)
 		return
 	}
 
+	err = h.trackPin(cid, "")
+	if err != nil {
+		response.SendError(w, 500, "Could not track pin", err)
+		return
+	}
+
 	fmt.Printf("Pinned file with cid: %s\n", cid)
 
 	res := &response.UploadImageResponse{
-		Cid: cid,
+		Cid:         cid,
+		ContentType: "application/json",
+		Size:        len(fileData),
+	}
+	response.SendJson(w, res, http.StatusCreated)
+}
+
+// ipfsFormatContentTypes are the content types of the IPLD formats content
+// can be added in.
+var ipfsFormatContentTypes = map[string]string{
+	ipfs.FormatRaw:     "application/vnd.ipld.raw",
+	ipfs.FormatDagJson: "application/vnd.ipld.dag-json",
+	ipfs.FormatDagCbor: "application/vnd.ipld.dag-cbor",
+}
+
+// addToIpfs pins the request body byte for byte, unlike addJsonToIpfs, so
+// clients can compute the same cid on their own.
+func (h *Handler) addToIpfs(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	// optional queries
+	format, err := request.ParseIpfsFormat(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid format.", err)
+		return
+	}
+	name := request.ParseNameFromQuery(r)
+
+	data, err := request.ParseBody(r)
+	if err != nil {
+		response.SendError(w, 400, "Could not read body.", err)
+		return
+	}
+
+	if format == ipfs.FormatRaw && len(data) > ipfs.MaxBlockSize {
+		response.SendError(w, 413, "Raw blocks can't be larger than 1MiB.", errs.ErrBadRequest)
+		return
+	}
+	if (format == ipfs.FormatDagJson || format == ipfs.FormatDagCbor) && !json.Valid(data) {
+		response.SendError(w, 400, "Could not parse json request.", errs.ErrBadRequest)
+		return
+	}
+
+	cid, err := h.ipfs.AddAs(data, name, format)
+	if err != nil {
+		response.SendError(w, 500, "Could not pin file to IPFS", err)
+		return
+	}
+
+	err = h.trackPin(cid, "")
+	if err != nil {
+		response.SendError(w, 500, "Could not track pin", err)
+		return
+	}
+
+	fmt.Printf("Pinned %s with cid: %s\n", format, cid)
+
+	contentType, ok := ipfsFormatContentTypes[format]
+	if !ok {
+		contentType = ipfsContentType(name, data)
+	}
+	res := &response.UploadImageResponse{
+		Filename:    name,
+		Cid:         cid,
+		ContentType: contentType,
+		Size:        len(data),
 	}
 	response.SendJson(w, res, http.StatusCreated)
 }
 
+func (h *Handler) ListIpfsPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.listIpfsPins(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+func (h *Handler) IpfsPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.getIpfsPin(w, r)
+		return
+	} else if r.Method == http.MethodDelete {
+		h.deleteIpfsPin(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+// listIpfsPins lists the pins this server created, without asking the node
+// about each of them.
+func (h *Handler) listIpfsPins(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	res := &response.ListPinsResponse{
+		Pins: []*response.PinResponse{},
+	}
+	for _, pin := range h.pins.list() {
+		res.Pins = append(res.Pins, h.makePinResponse(pin.Cid, pin, nil))
+	}
+
+	response.SendJson(w, res, 200)
+}
+
+// getIpfsPin reports whether a cid is pinned on the node and what this
+// server pinned it for.
+func (h *Handler) getIpfsPin(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	c, err := request.ParseCidFromPinsUrl(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid cid.", err)
+		return
+	}
+
+	pinned, err := h.ipfs.IsPinned(c.String())
+	if err != nil {
+		response.SendError(w, 502, "Couldn't check ipfs pin.", err)
+		return
+	}
+
+	pin, _ := h.pins.get(c.String())
+	response.SendJson(w, h.makePinResponse(c.String(), pin, &pinned), 200)
+}
+
+// deleteIpfsPin unpins a cid from the node whether or not files still
+// refer to it. The stored files themselves are kept.
+func (h *Handler) deleteIpfsPin(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	c, err := request.ParseCidFromPinsUrl(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid cid.", err)
+		return
+	}
+
+	_, tracked := h.pins.get(c.String())
+	err = h.ipfs.Unpin(c.String())
+	if err != nil {
+		if !ipfs.IsNotPinned(err) {
+			response.SendError(w, 502, "Could not unpin file from IPFS", err)
+			return
+		}
+		if !tracked {
+			response.SendError(w, 404, "Cid is not pinned.", errs.ErrNotFound)
+			return
+		}
+	}
+	fmt.Printf("Unpinned cid: %s\n", c.String())
+
+	err = h.remotePins.remove(c.String())
+	if err == nil {
+		err = h.pins.remove(c.String())
+	}
+	if err != nil {
+		response.SendError(w, 500, "Could not untrack pin", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// makePinResponse describes the pin on cid, including its copies on remote
+// pinning services. pin is nil when this server didn't create it, and
+// pinned when the node wasn't asked.
+func (h *Handler) makePinResponse(cid string, pin *pinRecord, pinned *bool) *response.PinResponse {
+	res := &response.PinResponse{
+		Cid:       cid,
+		Pinned:    pinned,
+		Filenames: []string{},
+		Remote:    []*response.RemotePinResponse{},
+	}
+	if pin != nil {
+		res.Tracked = true
+		res.Standalone = pin.Standalone
+		res.Filenames = pin.Filenames
+		res.PinnedAt = &pin.PinnedAt
+	}
+
+	for _, remote := range h.remotePins.forCid(cid) {
+		res.Remote = append(res.Remote, &response.RemotePinResponse{
+			Service:   remote.Service,
+			RequestId: remote.RequestId,
+			Status:    remote.Status,
+			Attempts:  remote.Attempts,
+			Error:     remote.Error,
+			UpdatedAt: remote.UpdatedAt,
+		})
+	}
+
+	return res
+}
+
+// ipfsCacheControl marks gateway responses as cacheable forever, since the
+// content behind a cid can never change.
+const ipfsCacheControl = "public, max-age=29030400, immutable"
+
 func (h *Handler) getIpfsFile(w http.ResponseWriter, r *http.Request) {
-	// filename
-	pathArr := strings.Split(r.URL.Path, "ipfs/")
-	cid := pathArr[len(pathArr)-1]
-	if cid == "" {
-		response.SendBadRequest(w, "cid")
+	// cid and optional path inside it
+	c, subPath, err := request.ParseIpfsPath(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid cid.", err)
+		return
+	}
+
+	pinned, err := h.ipfs.IsPinned(c.String())
+	if err != nil {
+		response.SendError(w, 502, "Couldn't check ipfs pin.", err)
+		return
+	}
+	if !pinned {
+		response.SendError(w, 404, "Ipfs link is not locally pinned.", errs.ErrNotFound)
+		return
+	}
+
+	ipfsPath := path.Join("/ipfs", c.String(), subPath)
+	car := request.IsCarRequest(r)
+	etag := fmt.Sprintf("%q", strings.TrimPrefix(ipfsPath, "/ipfs/"))
+	if car {
+		etag = fmt.Sprintf("%q", strings.TrimPrefix(ipfsPath, "/ipfs/")+".car")
+	}
+	w.Header().Set("Vary", "Accept")
+	if r.Header.Get("If-None-Match") == etag {
+		setIpfsCacheHeaders(w, ipfsPath, etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if car {
+		h.exportIpfsCar(w, r, c.String(), subPath, etag)
+		return
+	}
+
+	// dag nodes aren't UnixFS files, the node serves them as they're stored
+	switch multicodec.Code(c.Type()) {
+	case multicodec.DagJson:
+		h.getIpfsDagNode(w, r, ipfsPath, ipfs.FormatDagJson, etag)
+		return
+	case multicodec.DagCbor:
+		h.getIpfsDagNode(w, r, ipfsPath, ipfs.FormatDagCbor, etag)
 		return
 	}
 
-	err := helper.IsIpfsFilePinned(cid)
+	stat, err := h.ipfs.Stat(ipfsPath)
 	if err != nil {
-		response.SendError(w, 500, "Ipfs link is not locally pinned.", err)
+		if _, ok := err.(*ipfs.Error); ok {
+			response.SendError(w, 404, "Couldn't find ipfs path.", err)
+		} else {
+			response.SendError(w, 502, "Couldn't get ipfs file.", err)
+		}
 		return
 	}
 
-	fileData, err := helper.GetIpfsFile(cid)
+	if stat.Type == "directory" {
+		links, err := h.ipfs.Ls(ipfsPath)
+		if err != nil {
+			response.SendError(w, 502, "Couldn't list ipfs directory.", err)
+			return
+		}
+		setIpfsCacheHeaders(w, ipfsPath, etag)
+		response.SendJson(w, &response.IpfsDirectoryResponse{
+			Cid:   stat.Hash,
+			Path:  ipfsPath,
+			Links: links,
+		}, 200)
+		return
+	}
+
+	// optional range
+	offset, length, partial, err := request.ParseRange(r, stat.Size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", stat.Size))
+		response.SendError(w, http.StatusRequestedRangeNotSatisfiable, "Invalid range.", err)
+		return
+	}
+	if !partial {
+		offset, length = 0, stat.Size
+	}
+
+	body, err := h.ipfs.CatStream(ipfsPath, offset, length)
+	if err != nil {
+		response.SendError(w, 502, "Couldn't get ipfs file.", err)
+		return
+	}
+	defer body.Close()
+
+	// sniff the type from the start of the file, which a range may skip
+	reader := bufio.NewReaderSize(body, 512)
+	head, _ := reader.Peek(512)
+	if offset > 0 {
+		head, err = h.readIpfsHead(ipfsPath)
+		if err != nil {
+			response.SendError(w, 502, "Couldn't get ipfs file.", err)
+			return
+		}
+	}
+
+	setIpfsCacheHeaders(w, ipfsPath, etag)
+	w.Header().Set("Content-Type", ipfsContentType(subPath, head))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, stat.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		fmt.Printf("Stopped streaming %s: %s\n", ipfsPath, err)
+	}
+}
+
+// getIpfsDagNode serves the dag node at ipfsPath encoded as codec, the
+// codec of its cid.
+func (h *Handler) getIpfsDagNode(w http.ResponseWriter, r *http.Request, ipfsPath string, codec string, etag string) {
+	data, err := h.ipfs.DagGet(ipfsPath, codec)
 	if err != nil {
-		response.SendError(w, 500, "Couldn't get ipfs file.", err)
+		if _, ok := err.(*ipfs.Error); ok {
+			response.SendError(w, 404, "Couldn't find ipfs path.", err)
+		} else {
+			response.SendError(w, 502, "Couldn't get ipfs dag node.", err)
+		}
 		return
 	}
 
-	response.SendFile(w, fileData, nil)
+	setIpfsCacheHeaders(w, ipfsPath, etag)
+	w.Header().Set("Content-Type", "application/vnd.ipld."+codec)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, _ = w.Write(data)
+}
+
+// exportIpfsCar streams the DAG under a cid, or under a path inside it, as
+// a CAR file that reproduces its cids exactly.
+func (h *Handler) exportIpfsCar(w http.ResponseWriter, r *http.Request, cid string, subPath string, etag string) {
+	ipfsPath := path.Join("/ipfs", cid, subPath)
+	root := cid
+	if subPath != "" {
+		stat, err := h.ipfs.Stat(ipfsPath)
+		if err != nil {
+			if _, ok := err.(*ipfs.Error); ok {
+				response.SendError(w, 404, "Couldn't find ipfs path.", err)
+			} else {
+				response.SendError(w, 502, "Couldn't get ipfs file.", err)
+			}
+			return
+		}
+		root = stat.Hash
+	}
+
+	if r.Method == http.MethodHead {
+		setIpfsCarHeaders(w, ipfsPath, etag, root)
+		return
+	}
+
+	body, err := h.ipfs.DagExport(root)
+	if err != nil {
+		response.SendError(w, 502, "Couldn't export ipfs dag.", err)
+		return
+	}
+	defer body.Close()
+
+	setIpfsCarHeaders(w, ipfsPath, etag, root)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		fmt.Printf("Stopped exporting %s: %s\n", root, err)
+	}
+}
+
+func setIpfsCarHeaders(w http.ResponseWriter, ipfsPath string, etag string, root string) {
+	setIpfsCacheHeaders(w, ipfsPath, etag)
+	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=1")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.car\"", root))
+}
+
+// setIpfsCacheHeaders is only used on successful responses, errors such as
+// an unreachable node must not be cached.
+func setIpfsCacheHeaders(w http.ResponseWriter, ipfsPath string, etag string) {
+	w.Header().Set("Cache-Control", ipfsCacheControl)
+	w.Header().Set("Etag", etag)
+	w.Header().Set("X-Ipfs-Path", ipfsPath)
+}
+
+func (h *Handler) readIpfsHead(ipfsPath string) ([]byte, error) {
+	body, err := h.ipfs.CatStream(ipfsPath, 0, 512)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// ipfsContentType guesses the type of a file from its name inside a
+// directory, if it has one, or else from its first bytes.
+func ipfsContentType(subPath string, head []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(subPath)); contentType != "" {
+		return contentType
+	}
+
+	contentType := http.DetectContentType(head)
+	trimmed := bytes.TrimSpace(head)
+	if strings.HasPrefix(contentType, "text/plain") && len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		contentType = "application/json"
+	}
+
+	return contentType
 }
@@ -0,0 +1,431 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/multiformats/go-multicodec"
+	"github.com/sealsurlaw/gouvre/ipfs"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func newIpfsTestServer(t *testing.T, pinToIpfs bool) *testServer {
+	t.Helper()
+
+	return newTestServer(t, map[string]interface{}{"pinToIpfs": pinToIpfs})
+}
+
+func TestGetIpfsFile(t *testing.T) {
+	s := newIpfsTestServer(t, true)
+	file := s.node.AddFile([]byte("hello, world"))
+	s.node.Pin(file)
+	unpinned := s.node.AddFile([]byte("not pinned"))
+	page := s.node.AddFile([]byte("<html><body>hi</body></html>"))
+	dir := s.node.AddDirectory(map[string]string{"hello.txt": file, "index.html": page})
+	s.node.Pin(dir)
+	dagJson := s.node.AddDag([]byte(`{"hello":"world"}`), multicodec.DagJson)
+	s.node.Pin(dagJson)
+	dagCbor := s.node.AddDag([]byte(`{"hello":"cbor"}`), multicodec.DagCbor)
+	s.node.Pin(dagCbor)
+
+	tests := []struct {
+		name        string
+		req         testRequest
+		failures    int
+		wantStatus  int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "pinned",
+			req:        testRequest{path: "/ipfs/" + file},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello, world",
+			wantHeaders: map[string]string{
+				"Content-Type":   "text/plain; charset=utf-8",
+				"Content-Length": "12",
+				"Accept-Ranges":  "bytes",
+				"Cache-Control":  ipfsCacheControl,
+				"Etag":           fmt.Sprintf("%q", file),
+				"X-Ipfs-Path":    "/ipfs/" + file,
+				"Vary":           "Accept",
+			},
+		},
+		{
+			name:       "gateway auth isn't needed",
+			req:        testRequest{path: "/ipfs/" + file, noAuth: true},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello, world",
+		},
+		{
+			name:       "unpinned",
+			req:        testRequest{path: "/ipfs/" + unpinned},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "bad cid",
+			req:        testRequest{path: "/ipfs/not-a-cid"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "node error",
+			req:        testRequest{path: "/ipfs/" + unpinned},
+			failures:   1,
+			wantStatus: http.StatusBadGateway,
+			wantHeaders: map[string]string{
+				"Cache-Control": "",
+			},
+		},
+		{
+			name:       "directory",
+			req:        testRequest{path: "/ipfs/" + dir},
+			wantStatus: http.StatusOK,
+			wantBody:   `"name":"hello.txt"`,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/json",
+				"Etag":         fmt.Sprintf("%q", dir),
+			},
+		},
+		{
+			name:       "file in directory",
+			req:        testRequest{path: fmt.Sprintf("/ipfs/%s/index.html", dir)},
+			wantStatus: http.StatusOK,
+			wantBody:   "<html><body>hi</body></html>",
+			wantHeaders: map[string]string{
+				"Content-Type": "text/html; charset=utf-8",
+				"Etag":         fmt.Sprintf("%q", dir+"/index.html"),
+			},
+		},
+		{
+			name:       "missing from directory",
+			req:        testRequest{path: fmt.Sprintf("/ipfs/%s/missing.txt", dir)},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "range",
+			req:        testRequest{path: "/ipfs/" + file, headers: map[string]string{"Range": "bytes=7-11"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "world",
+			wantHeaders: map[string]string{
+				"Content-Range":  "bytes 7-11/12",
+				"Content-Length": "5",
+				// typed from the start of the file, not the range
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:       "suffix range",
+			req:        testRequest{path: "/ipfs/" + file, headers: map[string]string{"Range": "bytes=-5"}},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "world",
+		},
+		{
+			name:        "unsatisfiable range",
+			req:         testRequest{path: "/ipfs/" + file, headers: map[string]string{"Range": "bytes=100-200"}},
+			wantStatus:  http.StatusRequestedRangeNotSatisfiable,
+			wantHeaders: map[string]string{"Content-Range": "bytes */12"},
+		},
+		{
+			name:       "head",
+			req:        testRequest{method: http.MethodHead, path: "/ipfs/" + file},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Content-Length": "12",
+				"Etag":           fmt.Sprintf("%q", file),
+			},
+		},
+		{
+			name:       "if-none-match",
+			req:        testRequest{path: "/ipfs/" + file, headers: map[string]string{"If-None-Match": fmt.Sprintf("%q", file)}},
+			wantStatus: http.StatusNotModified,
+			wantHeaders: map[string]string{
+				"Etag":          fmt.Sprintf("%q", file),
+				"Cache-Control": ipfsCacheControl,
+			},
+		},
+		{
+			name:       "if-none-match of other content",
+			req:        testRequest{path: "/ipfs/" + file, headers: map[string]string{"If-None-Match": fmt.Sprintf("%q", dir)}},
+			wantStatus: http.StatusOK,
+			wantBody:   "hello, world",
+		},
+		{
+			name:       "car",
+			req:        testRequest{path: fmt.Sprintf("/ipfs/%s?format=car", file)},
+			wantStatus: http.StatusOK,
+			wantBody:   "CARv1 " + file,
+			wantHeaders: map[string]string{
+				"Content-Type":        "application/vnd.ipld.car; version=1",
+				"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s.car\"", file),
+				"Etag":                fmt.Sprintf("%q", file+".car"),
+			},
+		},
+		{
+			name:       "car by accept header",
+			req:        testRequest{path: "/ipfs/" + file, headers: map[string]string{"Accept": "application/vnd.ipld.car"}},
+			wantStatus: http.StatusOK,
+			wantBody:   "CARv1 " + file,
+		},
+		{
+			name:       "car of a path in a directory",
+			req:        testRequest{path: fmt.Sprintf("/ipfs/%s/hello.txt?format=car", dir)},
+			wantStatus: http.StatusOK,
+			wantBody:   "CARv1 " + file,
+			wantHeaders: map[string]string{
+				"Content-Disposition": fmt.Sprintf("attachment; filename=\"%s.car\"", file),
+			},
+		},
+		{
+			name:       "car if-none-match",
+			req:        testRequest{path: fmt.Sprintf("/ipfs/%s?format=car", file), headers: map[string]string{"If-None-Match": fmt.Sprintf("%q", file+".car")}},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "dag-json",
+			req:        testRequest{path: "/ipfs/" + dagJson},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"hello":"world"}`,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/vnd.ipld.dag-json",
+				"Etag":         fmt.Sprintf("%q", dagJson),
+			},
+		},
+		{
+			name:       "dag-cbor",
+			req:        testRequest{path: "/ipfs/" + dagCbor},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"hello":"cbor"}`,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/vnd.ipld.dag-cbor",
+			},
+		},
+		{
+			name:        "dag-json head",
+			req:         testRequest{method: http.MethodHead, path: "/ipfs/" + dagJson},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Content-Length": "17"},
+		},
+		{
+			name:       "wrong method",
+			req:        testRequest{method: http.MethodPost, path: "/ipfs/" + file},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.node.FailNext(http.StatusInternalServerError, tt.failures)
+			// every check goes to the node
+			s.h.ipfs = ipfs.NewClient(s.node.URL, "Basic dXNlcjpwYXNz", s.h.ipfsConfig.TimeoutDuration(), 0)
+
+			resp, body := s.do(t, tt.req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", body, tt.wantBody)
+			}
+			if tt.req.method == http.MethodHead && body != "" {
+				t.Errorf("HEAD body = %q, want none", body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := resp.Header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIpfsPins(t *testing.T) {
+	s := newIpfsTestServer(t, true)
+	external := s.node.AddFile([]byte("pinned by someone else"))
+	s.node.Pin(external)
+	unpinned := s.node.AddFile([]byte("not pinned"))
+	raw := "raw block"
+	rawCid := s.node.AddFile([]byte(raw))
+	s.node.Unpin(rawCid)
+
+	var added response.UploadImageResponse
+
+	// the steps run in order against the same server
+	tests := []struct {
+		name       string
+		req        testRequest
+		wantStatus int
+		check      func(t *testing.T, body string)
+	}{
+		{
+			name:       "add json",
+			req:        testRequest{method: http.MethodPost, path: "/ipfs/json", body: `{"hello":"world"}`},
+			wantStatus: http.StatusCreated,
+			check: func(t *testing.T, body string) {
+				decode(t, body, &added)
+				if added.ContentType != "application/json" || !s.node.IsPinned(added.Cid) {
+					t.Errorf("added %+v, want pinned json", added)
+				}
+			},
+		},
+		{
+			name:       "add json without auth",
+			req:        testRequest{method: http.MethodPost, path: "/ipfs/json", body: `{}`, noAuth: true},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "add bad json",
+			req:        testRequest{method: http.MethodPost, path: "/ipfs/json", body: `{"hello":`},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "add raw",
+			req:        testRequest{method: http.MethodPost, path: "/ipfs/add?format=raw&name=block.bin", body: raw},
+			wantStatus: http.StatusCreated,
+			check: func(t *testing.T, body string) {
+				res := &response.UploadImageResponse{}
+				decode(t, body, res)
+				if res.Cid != rawCid || res.ContentType != "application/vnd.ipld.raw" || !s.node.IsPinned(rawCid) {
+					t.Errorf("added %+v, want pinned raw block %s", res, rawCid)
+				}
+			},
+		},
+		{
+			name:       "list pins",
+			req:        testRequest{path: "/ipfs/pins"},
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, body string) {
+				res := &response.ListPinsResponse{}
+				decode(t, body, res)
+				cids := []string{}
+				for _, pin := range res.Pins {
+					cids = append(cids, pin.Cid)
+					if !pin.Tracked || pin.Pinned != nil {
+						t.Errorf("pin %+v, want tracked without asking the node", pin)
+					}
+				}
+				// only what this server pinned
+				if len(cids) != 2 || !contains(cids, added.Cid) || !contains(cids, rawCid) {
+					t.Errorf("pins = %v, want %s and %s", cids, added.Cid, rawCid)
+				}
+			},
+		},
+		{
+			name:       "list pins without auth",
+			req:        testRequest{path: "/ipfs/pins", noAuth: true},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "pin status of a tracked pin",
+			req:        testRequest{path: "/ipfs/pins/" + rawCid},
+			wantStatus: http.StatusOK,
+			check:      checkPinResponse(rawCid, true, true),
+		},
+		{
+			name:       "pin status of an untracked pin",
+			req:        testRequest{path: "/ipfs/pins/" + external},
+			wantStatus: http.StatusOK,
+			check:      checkPinResponse(external, true, false),
+		},
+		{
+			name:       "pin status of an unpinned cid",
+			req:        testRequest{path: "/ipfs/pins/" + unpinned},
+			wantStatus: http.StatusOK,
+			check:      checkPinResponse(unpinned, false, false),
+		},
+		{
+			name:       "pin status of a bad cid",
+			req:        testRequest{path: "/ipfs/pins/not-a-cid"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unpin",
+			req:        testRequest{method: http.MethodDelete, path: "/ipfs/pins/" + rawCid},
+			wantStatus: http.StatusNoContent,
+			check: func(t *testing.T, body string) {
+				if s.node.IsPinned(rawCid) {
+					t.Errorf("%s is still pinned on the node", rawCid)
+				}
+			},
+		},
+		{
+			name:       "pin status after unpinning",
+			req:        testRequest{path: "/ipfs/pins/" + rawCid},
+			wantStatus: http.StatusOK,
+			check:      checkPinResponse(rawCid, false, false),
+		},
+		{
+			name:       "unpin again",
+			req:        testRequest{method: http.MethodDelete, path: "/ipfs/pins/" + rawCid},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unpin without auth",
+			req:        testRequest{method: http.MethodDelete, path: "/ipfs/pins/" + external, noAuth: true},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrong method",
+			req:        testRequest{method: http.MethodPut, path: "/ipfs/pins/" + external},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.do(t, tt.req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.check != nil {
+				tt.check(t, body)
+			}
+		})
+	}
+}
+
+func TestIpfsNotEnabled(t *testing.T) {
+	s := newIpfsTestServer(t, false)
+	file := s.node.AddFile([]byte("hello, world"))
+	s.node.Pin(file)
+
+	tests := []testRequest{
+		{path: "/ipfs/" + file},
+		{method: http.MethodHead, path: "/ipfs/" + file},
+		{path: fmt.Sprintf("/ipfs/%s?format=car", file)},
+		{method: http.MethodPost, path: "/ipfs/json", body: `{"hello":"world"}`},
+		{method: http.MethodPost, path: "/ipfs/add?format=raw", body: "raw block"},
+		{path: "/ipfs/pins"},
+		{path: "/ipfs/pins/" + file},
+		{method: http.MethodDelete, path: "/ipfs/pins/" + file},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.method, tt.path), func(t *testing.T) {
+			resp, body := s.do(t, tt)
+			if resp.StatusCode != http.StatusNotImplemented {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusNotImplemented, body)
+			}
+		})
+	}
+
+	// the node is never asked
+	for _, command := range []string{"pin/ls", "pin/rm", "add", "cat", "dag/export"} {
+		if n := s.node.Requests(command); n != 0 {
+			t.Errorf("%d %s requests, want 0", n, command)
+		}
+	}
+	if !s.node.IsPinned(file) {
+		t.Errorf("%s was unpinned", file)
+	}
+}
+
+func checkPinResponse(cid string, pinned bool, tracked bool) func(t *testing.T, body string) {
+	return func(t *testing.T, body string) {
+		res := &response.PinResponse{}
+		decode(t, body, res)
+		if res.Cid != cid || res.Pinned == nil || *res.Pinned != pinned || res.Tracked != tracked {
+			t.Errorf("pin = %s, want cid %s pinned %v tracked %v", body, cid, pinned, tracked)
+		}
+	}
+}
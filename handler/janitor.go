@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/config"
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+)
+
+// cachedThumbnail is one generated thumbnail found through the _deps file of
+// the original it was made from. The modification time is bumped every time
+// the thumbnail is served, so it doubles as the last access time.
+type cachedThumbnail struct {
+	fullFilePath string
+	original     *cachedOriginal
+	size         int64
+	lastAccess   time.Time
+}
+
+// cachedOriginal is a stored original and the filenames that refer to it.
+type cachedOriginal struct {
+	storagePath string
+	filenames   []string
+}
+
+// janitorRun summarizes the last pass of the thumbnail janitor.
+type janitorRun struct {
+	at      time.Time
+	evicted int
+	freed   int64
+}
+
+// RunThumbnailJanitor evicts thumbnails until the cache fits the configured
+// limits, then sleeps for the configured interval and does it again. It
+// never returns.
+func (h *Handler) RunThumbnailJanitor() {
+	for {
+		limits := h.getThumbnailCache()
+		time.Sleep(limits.IntervalDuration())
+
+		err := h.cleanThumbnailCache()
+		if err != nil {
+			log.Printf("Thumbnail janitor: %s", err)
+		}
+	}
+}
+
+func (h *Handler) getThumbnailCache() config.ThumbnailCache {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
+	return *h.thumbnailCache
+}
+
+// touchThumbnail marks a thumbnail as just used.
+func (h *Handler) touchThumbnail(thumbnailFilename string) {
+	now := time.Now()
+	_ = os.Chtimes(h.makeFullFilePath(thumbnailFilename), now, now)
+}
+
+func (h *Handler) cleanThumbnailCache() error {
+	limits := h.getThumbnailCache()
+	maxAge := limits.MaxAgeDuration()
+	if limits.MaxSize == 0 && maxAge == 0 {
+		return nil
+	}
+
+	thumbnails, missing, err := h.listCachedThumbnails()
+	if err != nil {
+		return err
+	}
+
+	// deps whose thumbnail is already gone
+	for original, deps := range missing {
+		err = h.evictThumbnails(original, deps)
+		if err != nil {
+			return err
+		}
+	}
+
+	// least recently used first
+	sort.Slice(thumbnails, func(i, j int) bool {
+		return thumbnails[i].lastAccess.Before(thumbnails[j].lastAccess)
+	})
+
+	var total int64
+	for _, thumbnail := range thumbnails {
+		total += thumbnail.size
+	}
+
+	evict := make(map[*cachedOriginal][]string)
+	run := janitorRun{at: time.Now()}
+	for _, thumbnail := range thumbnails {
+		expired := maxAge > 0 && time.Since(thumbnail.lastAccess) > maxAge
+		oversized := limits.MaxSize > 0 && total > limits.MaxSize
+		if !expired && !oversized {
+			break
+		}
+
+		evict[thumbnail.original] = append(evict[thumbnail.original], thumbnail.fullFilePath)
+		total -= thumbnail.size
+		run.evicted++
+		run.freed += thumbnail.size
+	}
+
+	for original, evicted := range evict {
+		err = h.evictThumbnails(original, evicted)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.janitorMu.Lock()
+	h.lastJanitorRun = &run
+	h.janitorMu.Unlock()
+
+	if run.evicted > 0 {
+		log.Printf("Thumbnail janitor evicted %d thumbnails (%d bytes)", run.evicted, run.freed)
+	}
+
+	return nil
+}
+
+// listCachedThumbnails finds every thumbnail through the _deps files of the
+// originals in the index, along with the deps whose thumbnail is already
+// gone. It doesn't change anything on disk.
+func (h *Handler) listCachedThumbnails() ([]*cachedThumbnail, map[*cachedOriginal][]string, error) {
+	originals, err := h.listOriginals()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thumbnails := []*cachedThumbnail{}
+	missing := make(map[*cachedOriginal][]string)
+	for _, original := range originals {
+		for _, dep := range h.readDepsFile(h.makeFullFilePath(original.storagePath)) {
+			info, err := os.Stat(dep)
+			if err != nil {
+				missing[original] = append(missing[original], dep)
+				continue
+			}
+
+			thumbnails = append(thumbnails, &cachedThumbnail{
+				fullFilePath: dep,
+				original:     original,
+				size:         info.Size(),
+				lastAccess:   info.ModTime(),
+			})
+		}
+	}
+
+	return thumbnails, missing, nil
+}
+
+// listOriginals groups the filenames in the index by stored original.
+func (h *Handler) listOriginals() ([]*cachedOriginal, error) {
+	records, _, err := h.index.List(&index.ListOptions{Sort: index.SortFilename})
+	if err != nil {
+		return nil, err
+	}
+
+	originals := make(map[string]*cachedOriginal)
+	for _, record := range records {
+		original, ok := originals[record.StoragePath]
+		if !ok {
+			original = &cachedOriginal{storagePath: record.StoragePath}
+			originals[record.StoragePath] = original
+		}
+		original.filenames = append(original.filenames, record.Filename)
+	}
+
+	list := []*cachedOriginal{}
+	for _, original := range originals {
+		list = append(list, original)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].storagePath < list[j].storagePath
+	})
+
+	return list, nil
+}
+
+// evictThumbnails removes thumbnails made from original and drops them from
+// its _deps file and from the index records of its filenames.
+func (h *Handler) evictThumbnails(original *cachedOriginal, thumbnails []string) error {
+	h.storageLocks.Lock(original.storagePath)
+	defer h.storageLocks.Unlock(original.storagePath)
+
+	evicted := make(map[string]bool)
+	for _, thumbnail := range thumbnails {
+		err := os.Remove(thumbnail)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		evicted[thumbnail] = true
+	}
+
+	// the original may have been deleted or overwritten in the meantime
+	fullFilePath := h.makeFullFilePath(original.storagePath)
+	depsFilename := fmt.Sprintf("%s_deps", fullFilePath)
+	if _, err := os.Stat(depsFilename); err != nil {
+		return nil
+	}
+
+	remaining := []string{}
+	for _, dep := range h.readDepsFile(fullFilePath) {
+		if !evicted[dep] {
+			remaining = append(remaining, dep)
+		}
+	}
+
+	var err error
+	if len(remaining) == 0 {
+		err = os.Remove(depsFilename)
+	} else {
+		err = helper.WriteFileAtomic(depsFilename, []byte(strings.Join(remaining, "\n")+"\n"), 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range original.filenames {
+		err = h.index.Update(filename, func(record *index.Record) error {
+			kept := []*index.Thumbnail{}
+			for _, thumbnail := range record.Thumbnails {
+				if !evicted[h.makeFullFilePath(thumbnail.StoragePath)] {
+					kept = append(kept, thumbnail)
+				}
+			}
+			record.Thumbnails = kept
+			return nil
+		})
+		if err != nil && err != errs.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+)
+
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobRetention is how long finished jobs can still be looked up.
+const jobRetention = 24 * time.Hour
+
+// thumbnailJob generates one thumbnail variant of an upload in the
+// background. The encryption secret travels in Secret, sealed to the job
+// so the journal never holds it in the clear nor anything usable as a
+// link, and is dropped once the job is finished.
+type thumbnailJob struct {
+	Id         string    `json:"id"`
+	Filename   string    `json:"filename"`
+	Resolution int       `json:"resolution"`
+	Cropped    bool      `json:"cropped"`
+	Secret     string    `json:"secret,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func (job *thumbnailJob) finished() bool {
+	return job.Status == jobDone || job.Status == jobFailed
+}
+
+// jobQueue is an in-process queue of thumbnail jobs. Every state change is
+// appended to a journal in stateDir, which is replayed on startup so jobs
+// queued or running when the process stopped are picked up again.
+type jobQueue struct {
+	mu      sync.Mutex
+	path    string
+	journal *os.File
+	jobs    map[string]*thumbnailJob
+	pending []string
+	wake    chan struct{}
+	entries int
+}
+
+func newJobQueue(dir string) (*jobQueue, error) {
+	q := &jobQueue{
+		path: fmt.Sprintf("%s/jobs.journal", dir),
+		jobs: make(map[string]*thumbnailJob),
+		wake: make(chan struct{}, 1),
+	}
+
+	err := q.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	err = q.compact()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// replay rebuilds the queue from the journal, where the last entry for a
+// job is its current state.
+func (q *jobQueue) replay() error {
+	file, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		job := &thumbnailJob{}
+		// a torn last line from a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), job) != nil || job.Id == "" {
+			continue
+		}
+		q.jobs[job.Id] = job
+	}
+
+	unfinished := []*thumbnailJob{}
+	for _, job := range q.jobs {
+		if !job.finished() {
+			job.Status = jobPending
+			unfinished = append(unfinished, job)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].CreatedAt.Before(unfinished[j].CreatedAt)
+	})
+	for _, job := range unfinished {
+		q.pending = append(q.pending, job.Id)
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the journal with one entry per job, dropping finished
+// jobs past jobRetention. Callers other than newJobQueue must hold mu.
+func (q *jobQueue) compact() error {
+	lines := []byte{}
+	for id, job := range q.jobs {
+		if job.finished() && time.Since(job.UpdatedAt) > jobRetention {
+			delete(q.jobs, id)
+			continue
+		}
+
+		line, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	if q.journal != nil {
+		q.journal.Close()
+	}
+
+	err := helper.WriteFileAtomic(q.path, lines, 0600)
+	if err != nil {
+		return err
+	}
+
+	q.journal, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	q.entries = len(q.jobs)
+
+	return nil
+}
+
+// record appends the current state of jobs to the journal in one write. If
+// it fails, the journal is cut back so none of them are left in it. Callers
+// must hold mu.
+func (q *jobQueue) record(jobs ...*thumbnailJob) error {
+	lines := []byte{}
+	for _, job := range jobs {
+		job.UpdatedAt = time.Now().UTC()
+
+		line, err := json.Marshal(job)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	stat, err := q.journal.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = q.journal.Write(lines)
+	if err == nil {
+		err = q.journal.Sync()
+	}
+	if err != nil {
+		_ = q.journal.Truncate(stat.Size())
+		return err
+	}
+	q.entries += len(jobs)
+
+	return nil
+}
+
+func (q *jobQueue) enqueue(jobs ...*thumbnailJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// keep the journal from growing without bound between restarts
+	if q.entries > 2*len(q.jobs)+1000 {
+		err := q.compact()
+		if err != nil {
+			return err
+		}
+	}
+
+	// journaled all at once so a failure doesn't leave part of an upload's
+	// jobs queued
+	for _, job := range jobs {
+		job.Status = jobPending
+		job.CreatedAt = time.Now().UTC()
+	}
+	err := q.record(jobs...)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		stored := *job
+		q.jobs[job.Id] = &stored
+		q.pending = append(q.pending, job.Id)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// next blocks until a job is pending, marks it running and returns a copy.
+func (q *jobQueue) next() *thumbnailJob {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			job := q.jobs[q.pending[0]]
+			q.pending = q.pending[1:]
+			// let the other workers know there's more
+			if len(q.pending) > 0 {
+				select {
+				case q.wake <- struct{}{}:
+				default:
+				}
+			}
+
+			job.Status = jobRunning
+			err := q.record(job)
+			if err != nil {
+				log.Printf("Couldn't journal job %s: %s", job.Id, err)
+			}
+			jobCopy := *job
+			q.mu.Unlock()
+
+			return &jobCopy
+		}
+		q.mu.Unlock()
+
+		<-q.wake
+	}
+}
+
+// finish records the outcome of a job returned by next.
+func (q *jobQueue) finish(id string, jobErr error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+
+	job.Secret = ""
+	job.Status = jobDone
+	if jobErr != nil {
+		job.Status = jobFailed
+		job.Error = jobErr.Error()
+	}
+
+	err := q.record(job)
+	if err != nil {
+		log.Printf("Couldn't journal job %s: %s", job.Id, err)
+	}
+}
+
+// get returns a copy of the job with id.
+func (q *jobQueue) get(id string) (*thumbnailJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, errs.ErrNotFound
+	}
+	jobCopy := *job
+
+	return &jobCopy, nil
+}
+
+// StartThumbnailJobs starts the workers that generate queued thumbnails.
+// They share the decode slots with thumbnails requested interactively, so
+// only half as many are started, leaving the other slots to those requests.
+func (h *Handler) StartThumbnailJobs() {
+	workers := cap(h.decodeSlots) / 2
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job := h.jobs.next()
+				h.jobs.finish(job.Id, h.runThumbnailJob(job))
+			}
+		}()
+	}
+}
+
+func (h *Handler) runThumbnailJob(job *thumbnailJob) error {
+	secret := ""
+	if job.Secret != "" {
+		var err error
+		secret, err = h.tokenizer.OpenSecret(jobSecretPurpose(job.Id), job.Secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	tp := &ThumbnailParameters{job.Filename, job.Resolution, job.Cropped, secret}
+	_, err := h.checkOrCreateThumbnailFile(tp)
+	// Gifs are served as the original
+	if err == errs.ErrGif {
+		return nil
+	}
+
+	return err
+}
+
+// enqueueThumbnails queues a cropped and an uncropped thumbnail of filename
+// for every resolution.
+func (h *Handler) enqueueThumbnails(filename string, resolutions []int, encryptionSecret string) ([]*thumbnailJob, error) {
+	jobs := []*thumbnailJob{}
+	for _, resolution := range resolutions {
+		for _, cropped := range []bool{false, true} {
+			job := &thumbnailJob{
+				Id:         uuid.NewString(),
+				Filename:   filename,
+				Resolution: resolution,
+				Cropped:    cropped,
+			}
+			if encryptionSecret != "" {
+				job.Secret = h.tokenizer.SealSecret(jobSecretPurpose(job.Id), encryptionSecret)
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	err := h.jobs.enqueue(jobs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// jobSecretPurpose binds the sealed secret of a job to that job.
+func jobSecretPurpose(id string) string {
+	return "thumbnail job " + id
+}
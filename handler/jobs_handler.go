@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sealsurlaw/gouvre/request"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.getJob(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+// getJob needs no auth token: job ids are random and only handed to whoever
+// queued the job, like upload links.
+func (h *Handler) getJob(w http.ResponseWriter, r *http.Request) {
+	id, err := request.ParseTokenFromUrl(r)
+	if err != nil {
+		response.SendBadRequest(w, "job id")
+		return
+	}
+
+	job, err := h.jobs.get(id)
+	if err != nil {
+		response.SendError(w, 404, "Couldn't find job.", err)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	response.SendJson(w, h.makeJobResponse(job), 200)
+}
+
+func (h *Handler) makeJobResponse(job *thumbnailJob) *response.JobResponse {
+	return &response.JobResponse{
+		Id:         job.Id,
+		Url:        h.makeJobUrl(job.Id),
+		Filename:   job.Filename,
+		Resolution: job.Resolution,
+		Cropped:    job.Cropped,
+		Status:     job.Status,
+		Error:      job.Error,
+		CreatedAt:  job.CreatedAt,
+		UpdatedAt:  job.UpdatedAt,
+	}
+}
+
+func (h *Handler) makeJobUrl(id string) string {
+	return fmt.Sprintf("%s/jobs/%s", h.BaseUrl, id)
+}
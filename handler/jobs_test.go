@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func TestJobJournalHoldsNoLinks(t *testing.T) {
+	s := newTestServer(t, nil)
+	const secret = "upload-secret"
+
+	resp, body := s.do(t, testRequest{
+		method: http.MethodPost,
+		path:   "/images/links/upload",
+		body:   fmt.Sprintf(`{"filename": "photo.png", "secret": %q, "resolutions": [32]}`, secret),
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	link := &response.GetLinkResponse{}
+	decode(t, body, link)
+	resp, body = s.upload(t, s.linkPath(link.Url), testPng(t, 64, 64), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want %d: %s", resp.StatusCode, http.StatusCreated, body)
+	}
+
+	journal := fmt.Sprintf("%s/%s/jobs.journal", s.basePath, stateDir)
+	jobs := readJournal(t, journal)
+	if len(jobs) != 2 {
+		t.Fatalf("%d jobs journaled, want 2", len(jobs))
+	}
+	for _, job := range jobs {
+		if job.Secret == "" || strings.Contains(job.Secret, secret) {
+			t.Fatalf("job %s secret = %q, want it sealed", job.Id, job.Secret)
+		}
+		if _, err := s.h.tokenizer.ParseTokenData(job.Secret); err == nil {
+			t.Errorf("job %s secret parses as a link token", job.Id)
+		}
+		resp, body := s.do(t, testRequest{path: "/images/links/" + job.Secret, noAuth: true})
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("job %s secret works as a link: %s", job.Id, body)
+		}
+		// only the job it was sealed for can open it
+		if _, err := s.h.tokenizer.OpenSecret(jobSecretPurpose("another-job"), job.Secret); err == nil {
+			t.Errorf("job %s secret opens for another job", job.Id)
+		}
+	}
+
+	resp, body = s.do(t, testRequest{path: fmt.Sprintf("/images/%s/jobs.journal", stateDir), noAuth: true})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET of the journal status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, body)
+	}
+
+	// the job still gets the secret, and drops it once done
+	for range jobs {
+		job := s.h.jobs.next()
+		s.h.jobs.finish(job.Id, s.h.runThumbnailJob(job))
+	}
+	for _, job := range readJournal(t, journal) {
+		if job.Status != jobDone || job.Secret != "" {
+			t.Errorf("job %s is %s with secret %q, want done without one: %s", job.Id, job.Status, job.Secret, job.Error)
+		}
+	}
+}
+
+// readJournal returns the latest state of every job in a journal.
+func readJournal(t *testing.T, path string) map[string]*thumbnailJob {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	jobs := make(map[string]*thumbnailJob)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		job := &thumbnailJob{}
+		err := json.Unmarshal(scanner.Bytes(), job)
+		if err != nil {
+			t.Fatalf("couldn't parse journal line %q: %s", scanner.Text(), err)
+		}
+		jobs[job.Id] = job
+	}
+
+	return jobs
+}
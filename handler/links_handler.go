@@ -2,6 +2,7 @@ package handler
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/helper"
@@ -30,7 +31,10 @@ func (h *Handler) CreateImageUploadLink(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *Handler) GetImageFromTokenLink(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet && request.IsInfoRequest(r) {
+		h.getImageInfoFromTokenLink(w, r)
+		return
+	} else if r.Method == http.MethodGet {
 		h.getImageFromTokenLink(w, r)
 		return
 	} else if r.Method == http.MethodPost {
@@ -69,13 +73,22 @@ func (h *Handler) createLink(w http.ResponseWriter, r *http.Request) {
 	// optional queries
 	expiresAt := request.ParseExpires(r)
 
-	filename, err := h.checkFileExists(req.Filename, req.Secret)
-	if err != nil {
+	_, err = h.checkFileExists(req.Filename, req.Secret)
+	if err == errs.ErrReservedFilename {
+		response.SendReservedFilename(w)
+		return
+	} else if err != nil {
 		response.SendCouldntFindImage(w, err)
 		return
 	}
 
-	token, err := h.tokenizer.CreateToken(filename, expiresAt, req.Secret, nil)
+	err = h.revocations.coverLink(expiresAt)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
+	}
+
+	token, err := h.tokenizer.CreateFileToken(req.Filename, expiresAt, req.Secret, 0, false)
 	if err != nil {
 		response.SendError(w, 500, "Couldn't create token.", err)
 		return
@@ -106,16 +119,27 @@ func (h *Handler) createUploadLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if checkFilename(req.Filename) != nil {
+		response.SendReservedFilename(w)
+		return
+	}
+
 	// optional queries
 	expiresAt := request.ParseExpires(r)
 
+	err = h.revocations.coverLink(expiresAt)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
+	}
+
 	token, err := h.tokenizer.CreateToken(req.Filename, expiresAt, req.Secret, req.Resolutions)
 	if err != nil {
 		response.SendError(w, 500, "Couldn't create token.", err)
 		return
 	}
 
-	h.singleUseUploadTokens[token] = true
+	h.addUploadToken(token)
 
 	response.SendJson(w, &response.GetLinkResponse{
 		Url:       h.makeUploadTokenUrl(token),
@@ -130,12 +154,20 @@ func (h *Handler) getImageFromTokenLink(w http.ResponseWriter, r *http.Request)
 		response.SendBadRequest(w, "token")
 	}
 
-	filename, expiresAt, secret, _, err := h.tokenizer.ParseToken(token)
+	tokenData, err := h.tokenizer.ParseTokenData(token)
 	if err != nil {
 		response.SendError(w, 500, "Couldn't parse token.", err)
 		return
 	}
 
+	if h.revocations.isRevoked(tokenData) {
+		response.SendError(w, 410, "Link has been revoked.", errs.ErrTokenRevoked)
+		return
+	}
+
+	secret := tokenData.EncryptionSecret
+	expiresAt := time.Unix(tokenData.ExpiresAt, 0)
+
 	if secret == "" {
 		if r.Method == http.MethodGet {
 			secret = request.ParseEncryptionSecretFromQuery(r)
@@ -148,6 +180,12 @@ func (h *Handler) getImageFromTokenLink(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	filename, err := h.resolveTokenFile(tokenData, secret)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't check/create thumbnail file.", err)
+		return
+	}
+
 	// open file
 	fullFilePath := h.makeFullFilePath(filename)
 	fileData, err := helper.OpenFile(fullFilePath)
@@ -160,5 +198,5 @@ func (h *Handler) getImageFromTokenLink(w http.ResponseWriter, r *http.Request)
 	_ = h.tryDecryptFile(&fileData, secret)
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	response.SendFile(w, fileData, expiresAt)
+	response.SendFile(w, fileData, &expiresAt)
 }
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/request"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func (h *Handler) ListImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.listImages(w, r)
+		return
+	} else {
+		response.SendMethodNotFound(w)
+		return
+	}
+}
+
+func (h *Handler) listImages(w http.ResponseWriter, r *http.Request) {
+	if !h.hasWhitelistedToken(r) {
+		response.SendInvalidAuthToken(w)
+		return
+	}
+
+	if !h.hasWhitelistedIpAddress(r) {
+		response.SendError(w, 401, "Not on ip whitelist.", errs.ErrNotAuthorized)
+		return
+	}
+
+	// optional queries
+	opts, err := request.ParseListOptions(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid sort, order or limit.", err)
+		return
+	}
+	metadata := request.ParseMetadata(r)
+
+	records, nextCursor, err := h.index.List(opts)
+	if err != nil {
+		response.SendError(w, 400, "Couldn't list files.", err)
+		return
+	}
+
+	res := &response.ListImagesResponse{
+		Filenames:  []string{},
+		NextCursor: nextCursor,
+	}
+	for _, record := range records {
+		res.Filenames = append(res.Filenames, record.Filename)
+	}
+	if metadata {
+		res.Files = records
+	}
+
+	response.SendJson(w, res, 200)
+}
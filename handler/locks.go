@@ -0,0 +1,44 @@
+package handler
+
+import "sync"
+
+// keyedMutex serializes work on the same key while letting work on different
+// keys run concurrently. Locks are dropped once nobody holds or waits on them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+func (km *keyedMutex) Lock(key string) {
+	km.mu.Lock()
+	lock, ok := km.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		km.locks[key] = lock
+	}
+	lock.refs++
+	km.mu.Unlock()
+
+	lock.mu.Lock()
+}
+
+func (km *keyedMutex) Unlock(key string) {
+	km.mu.Lock()
+	lock := km.locks[key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(km.locks, key)
+	}
+	km.mu.Unlock()
+
+	lock.mu.Unlock()
+}
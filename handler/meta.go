@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/helper"
+)
+
+// fileMeta is stored next to every original as "<file>_meta". It only holds
+// what can't be recovered from the file itself; content details such as the
+// dimensions are read from the (decrypted) file on demand so nothing about
+// an encrypted file's content is written in the clear.
+type fileMeta struct {
+	Filename    string    `json:"filename"`
+	Cid         string    `json:"cid,omitempty"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+	Encrypted   bool      `json:"encrypted"`
+	UploaderKey string    `json:"uploaderKey,omitempty"`
+	// StoragePath is where the content lives when it's not stored under
+	// the file's own name, see storeFile.
+	StoragePath string `json:"storagePath,omitempty"`
+	// Checksum is the sha-256 of an encrypted file's ciphertext, which lets
+	// the scrubber verify it without the secret. The cid is of the plaintext.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+func newFileMeta(r *http.Request, filename string, cid string, encryptionSecret string) *fileMeta {
+	return &fileMeta{
+		Filename:    filename,
+		Cid:         cid,
+		UploadedAt:  time.Now().UTC(),
+		Encrypted:   encryptionSecret != "",
+		UploaderKey: uploaderKey(r),
+	}
+}
+
+// uploaderKey identifies the whitelisted token a request was made with
+// without storing the token itself.
+func uploaderKey(r *http.Request) string {
+	authSplit := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authSplit) != 2 || authSplit[0] != "Bearer" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(authSplit[1]))
+	return hex.EncodeToString(sum[:8])
+}
+
+// checksum returns the sha-256 of fileData as stored in fileMeta.Checksum.
+func checksum(fileData []byte) string {
+	sum := sha256.Sum256(fileData)
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *Handler) readMetaFile(fullFilePath string) (*fileMeta, error) {
+	metaData, err := os.ReadFile(fmt.Sprintf("%s_meta", fullFilePath))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &fileMeta{}
+	err = json.Unmarshal(metaData, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (h *Handler) writeMetaFile(fullFilePath string, meta *fileMeta) error {
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(fmt.Sprintf("%s_meta", fullFilePath), metaData, 0600)
+}
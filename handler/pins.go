@@ -0,0 +1,251 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+	"github.com/sealsurlaw/gouvre/ipfs"
+)
+
+// pinRecord is a pin this server created on the IPFS node, along with the
+// filenames whose content it is. Standalone pins were added directly, e.g.
+// through /ipfs/json, and are only removed on request.
+type pinRecord struct {
+	Cid        string    `json:"cid"`
+	Filenames  []string  `json:"filenames"`
+	Standalone bool      `json:"standalone,omitempty"`
+	PinnedAt   time.Time `json:"pinnedAt"`
+}
+
+// orphaned reports whether nothing refers to the pin anymore.
+func (pin *pinRecord) orphaned() bool {
+	return len(pin.Filenames) == 0 && !pin.Standalone
+}
+
+// pinRegistry keeps track of the pins this server created so they can be
+// listed and removed once the files they were made for are gone. It's
+// persisted in stateDir like the revocation list.
+type pinRegistry struct {
+	mu   sync.Mutex
+	path string
+	pins map[string]*pinRecord
+}
+
+func newPinRegistry(dir string) *pinRegistry {
+	pr := &pinRegistry{
+		path: fmt.Sprintf("%s/pins.json", dir),
+		pins: make(map[string]*pinRecord),
+	}
+
+	data, err := os.ReadFile(pr.path)
+	if err == nil {
+		err = json.Unmarshal(data, &pr.pins)
+		if err != nil {
+			fmt.Printf("Couldn't parse %s: %s\n", pr.path, err)
+		}
+	}
+
+	return pr
+}
+
+// exists reports whether the registry has been persisted before.
+func (pr *pinRegistry) exists() bool {
+	_, err := os.Stat(pr.path)
+	return err == nil
+}
+
+// seed registers the cids of indexed files, which were pinned before
+// pins were tracked.
+func (pr *pinRegistry) seed(records []*index.Record) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for _, record := range records {
+		if record.Cid != "" {
+			pr.addLocked(record.Cid, record.Filename, record.UploadedAt)
+		}
+	}
+
+	return pr.save()
+}
+
+// add records that cid was pinned for filename, or on its own when
+// filename is empty.
+func (pr *pinRegistry) add(cid string, filename string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.addLocked(cid, filename, time.Now().UTC())
+
+	return pr.save()
+}
+
+func (pr *pinRegistry) addLocked(cid string, filename string, pinnedAt time.Time) {
+	pin, ok := pr.pins[cid]
+	if !ok {
+		pin = &pinRecord{Cid: cid, Filenames: []string{}, PinnedAt: pinnedAt}
+		pr.pins[cid] = pin
+	}
+
+	if filename == "" {
+		pin.Standalone = true
+		return
+	}
+	for _, f := range pin.Filenames {
+		if f == filename {
+			return
+		}
+	}
+	pin.Filenames = append(pin.Filenames, filename)
+}
+
+// release drops filename from the pin on cid and reports whether the pin is
+// left orphaned. Untracked cids are never orphaned, they weren't pinned by
+// this server.
+func (pr *pinRegistry) release(cid string, filename string) (bool, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pin, ok := pr.pins[cid]
+	if !ok {
+		return false, nil
+	}
+
+	kept := []string{}
+	for _, f := range pin.Filenames {
+		if f != filename {
+			kept = append(kept, f)
+		}
+	}
+	pin.Filenames = kept
+
+	return pin.orphaned(), pr.save()
+}
+
+// remove forgets the pin on cid once it's been unpinned.
+func (pr *pinRegistry) remove(cid string) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if _, ok := pr.pins[cid]; !ok {
+		return nil
+	}
+	delete(pr.pins, cid)
+
+	return pr.save()
+}
+
+// get returns a copy of the pin on cid.
+func (pr *pinRegistry) get(cid string) (*pinRecord, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pin, ok := pr.pins[cid]
+	if !ok {
+		return nil, false
+	}
+	pinCopy := *pin
+	pinCopy.Filenames = append([]string{}, pin.Filenames...)
+
+	return &pinCopy, true
+}
+
+// list returns copies of every pin, oldest first.
+func (pr *pinRegistry) list() []*pinRecord {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pins := []*pinRecord{}
+	for _, pin := range pr.pins {
+		pinCopy := *pin
+		pinCopy.Filenames = append([]string{}, pin.Filenames...)
+		pins = append(pins, &pinCopy)
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].PinnedAt.Equal(pins[j].PinnedAt) {
+			return pins[i].Cid < pins[j].Cid
+		}
+		return pins[i].PinnedAt.Before(pins[j].PinnedAt)
+	})
+
+	return pins
+}
+
+// save persists the registry. Callers must hold mu.
+func (pr *pinRegistry) save() error {
+	data, err := json.Marshal(pr.pins)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(pr.path, data, 0600)
+}
+
+// pinFile adds fileData to the IPFS node for filename and tracks the pin.
+func (h *Handler) pinFile(fileData []byte, filename string) (string, error) {
+	cid, err := h.ipfs.Add(fileData, filename)
+	if err != nil {
+		return "", err
+	}
+
+	// files uploaded without a name are stored under their cid
+	if filename == "" {
+		filename = cid
+	}
+	err = h.trackPin(cid, filename)
+	if err != nil {
+		return "", err
+	}
+
+	return cid, nil
+}
+
+// trackPin records a pin made for filename, or on its own when filename is
+// empty, and queues it for the remote pinning services.
+func (h *Handler) trackPin(cid string, filename string) error {
+	err := h.pins.add(cid, filename)
+	if err != nil {
+		return err
+	}
+
+	return h.remotePins.add(cid, filename)
+}
+
+// releasePin drops filename's claim on the pin on cid, and unpins it when
+// it was the last one and unpin is set. A pin that couldn't be removed
+// stays listed so it can be unpinned later.
+func (h *Handler) releasePin(cid string, filename string, unpin bool) error {
+	if cid == "" || !h.pinToIpfs {
+		return nil
+	}
+
+	orphaned, err := h.pins.release(cid, filename)
+	if err != nil || !orphaned || !unpin {
+		return err
+	}
+
+	return h.unpin(cid)
+}
+
+// unpin removes the pin on cid from the node, if it's still there, queues
+// its removal from the remote pinning services and stops tracking it.
+func (h *Handler) unpin(cid string) error {
+	err := h.ipfs.Unpin(cid)
+	if err != nil && !ipfs.IsNotPinned(err) {
+		return err
+	}
+	fmt.Printf("Unpinned cid: %s\n", cid)
+
+	err = h.remotePins.remove(cid)
+	if err != nil {
+		return err
+	}
+
+	return h.pins.remove(cid)
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/sealsurlaw/gouvre/config"
+)
+
+// Reload swaps the runtime-reloadable settings from cfg into the handler and
+// logs what changed. The thumbnail settings are reloadable, quality as well
+// as the limits in batchParallelism and thumbnailCache, except for
+// thumbnailWorkers. Settings that are baked into stored files or issued
+// links (basePath, baseUrl, hashFilename, pinToIpfs, cidLayout) or set up
+// at startup (thumbnailWorkers, index, ipfs) are only reported, since they
+// need a restart to take effect safely.
+func (h *Handler) Reload(cfg *config.Config) {
+	h.settingsMu.Lock()
+	changes := []string{}
+	if h.thumbnailQuality != cfg.ThumbnailQuality {
+		changes = append(changes, fmt.Sprintf("thumbnailQuality %d -> %d", h.thumbnailQuality, cfg.ThumbnailQuality))
+	}
+	if h.batchParallelism != cfg.BatchParallelism {
+		changes = append(changes, fmt.Sprintf("batchParallelism %d -> %d", h.batchParallelism, cfg.BatchParallelism))
+	}
+	if !equalStrings(h.whitelistedTokens, cfg.WhitelistedTokens) {
+		changes = append(changes, fmt.Sprintf("whitelistedTokens (%d -> %d entries)", len(h.whitelistedTokens), len(cfg.WhitelistedTokens)))
+	}
+	if !equalStrings(h.whitelistedIpAddresses, cfg.WhitelistedIpAddresses) {
+		changes = append(changes, fmt.Sprintf("whitelistedIpAddresses %v -> %v", h.whitelistedIpAddresses, cfg.WhitelistedIpAddresses))
+	}
+
+	if !reflect.DeepEqual(h.metadataPolicy, cfg.MetadataPolicy) {
+		changes = append(changes, "metadataPolicy")
+	}
+	if *h.thumbnailCache != *cfg.ThumbnailCache {
+		changes = append(changes, fmt.Sprintf("thumbnailCache %+v -> %+v", *h.thumbnailCache, *cfg.ThumbnailCache))
+	}
+	if *h.scrubber != *cfg.Scrubber {
+		changes = append(changes, fmt.Sprintf("scrubber %+v -> %+v", *h.scrubber, *cfg.Scrubber))
+	}
+
+	h.thumbnailQuality = cfg.ThumbnailQuality
+	h.batchParallelism = cfg.BatchParallelism
+	h.whitelistedTokens = cfg.WhitelistedTokens
+	h.whitelistedIpAddresses = cfg.WhitelistedIpAddresses
+	h.metadataPolicy = cfg.MetadataPolicy
+	h.thumbnailCache = cfg.ThumbnailCache
+	h.scrubber = cfg.Scrubber
+	h.settingsMu.Unlock()
+
+	ignored := []string{}
+	if h.BaseUrl != cfg.BaseUrl {
+		ignored = append(ignored, "baseUrl")
+	}
+	if h.BasePath != cfg.BasePath {
+		ignored = append(ignored, "basePath")
+	}
+	if h.hashFilename != cfg.HashFilename {
+		ignored = append(ignored, "hashFilename")
+	}
+	if h.pinToIpfs != cfg.PinToIpfs {
+		ignored = append(ignored, "pinToIpfs")
+	}
+	if h.cidLayout != cfg.CidLayout {
+		ignored = append(ignored, "cidLayout")
+	}
+	if !reflect.DeepEqual(h.ipfsConfig, *cfg.Ipfs) {
+		ignored = append(ignored, "ipfs")
+	}
+	if cap(h.decodeSlots) != cfg.ThumbnailWorkers {
+		ignored = append(ignored, "thumbnailWorkers")
+	}
+	if h.indexConfig.Driver != cfg.Index.Driver || h.indexConfig.Dsn != cfg.Index.Dsn {
+		ignored = append(ignored, "index")
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("Config reloaded, no reloadable settings changed")
+	} else {
+		fmt.Printf("Config reloaded: %s\n", strings.Join(changes, ", "))
+	}
+	if len(ignored) > 0 {
+		fmt.Printf("Restart required to apply: %s\n", strings.Join(ignored, ", "))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
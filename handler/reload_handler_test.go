@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/config"
+)
+
+func TestReloadThumbnailSettings(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.h
+	workers := cap(h.decodeSlots)
+
+	cache := config.ThumbnailCache{MaxSize: 1 << 20, MaxAge: "24h", Interval: "1h"}
+	h.Reload(&config.Config{
+		BaseUrl:                h.BaseUrl,
+		BasePath:               h.BasePath,
+		ThumbnailQuality:       90,
+		ThumbnailWorkers:       workers + 1,
+		BatchParallelism:       3,
+		CidLayout:              h.cidLayout,
+		WhitelistedTokens:      h.whitelistedTokens,
+		WhitelistedIpAddresses: h.whitelistedIpAddresses,
+		Ipfs:                   &h.ipfsConfig,
+		MetadataPolicy:         h.metadataPolicy,
+		Index:                  &h.indexConfig,
+		ThumbnailCache:         &cache,
+		Scrubber:               &config.Scrubber{},
+	})
+
+	if got := h.getThumbnailQuality(); got != 90 {
+		t.Errorf("thumbnail quality = %d, want 90", got)
+	}
+	if got := h.getBatchParallelism(); got != 3 {
+		t.Errorf("batch parallelism = %d, want 3", got)
+	}
+	if got := h.getThumbnailCache(); got != cache {
+		t.Errorf("thumbnail cache = %+v, want %+v", got, cache)
+	}
+	if got := cap(h.decodeSlots); got != workers {
+		t.Errorf("thumbnail workers = %d, want %d until a restart", got, workers)
+	}
+}
@@ -0,0 +1,368 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/ipfs"
+)
+
+// Local states of a remote pin next to the ones reported by the service.
+const (
+	remotePending  = "pending"
+	remoteRemoving = "removing"
+)
+
+// remotePinMaxAttempts is how many times in a row a request to a pinning
+// service may fail before the pin is given up on.
+const remotePinMaxAttempts = 10
+
+// remotePinCheck is how often a submitted pin request is checked until the
+// service has pinned it.
+const remotePinCheck = 30 * time.Second
+
+// remotePin replicates a pin this server created to a pinning service.
+type remotePin struct {
+	Service     string    `json:"service"`
+	Cid         string    `json:"cid"`
+	Name        string    `json:"name,omitempty"`
+	RequestId   string    `json:"requestId,omitempty"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func (pin *remotePin) key() string {
+	return remotePinKey(pin.Service, pin.Cid)
+}
+
+func remotePinKey(service string, cid string) string {
+	return fmt.Sprintf("%s %s", service, cid)
+}
+
+// settled reports whether there's nothing left to do for the pin.
+func (pin *remotePin) settled() bool {
+	return pin.Status == ipfs.RemotePinned || pin.Status == ipfs.RemoteFailed
+}
+
+// remotePinQueue keeps the state of every remote pin, persisted in
+// stateDir, and hands out the ones that are due for a request to their
+// service. Pins stay in the queue once pinned so they can be removed later.
+type remotePinQueue struct {
+	mu       sync.Mutex
+	path     string
+	services []*ipfs.RemoteClient
+	pins     map[string]*remotePin
+	wake     chan struct{}
+}
+
+func newRemotePinQueue(dir string, services []*ipfs.RemoteClient) *remotePinQueue {
+	q := &remotePinQueue{
+		path:     fmt.Sprintf("%s/remote_pins.json", dir),
+		services: services,
+		pins:     make(map[string]*remotePin),
+		wake:     make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(q.path)
+	if err == nil {
+		err = json.Unmarshal(data, &q.pins)
+		if err != nil {
+			fmt.Printf("Couldn't parse %s: %s\n", q.path, err)
+		}
+	}
+
+	return q
+}
+
+// add queues cid to be pinned on every service. Pins that failed or are
+// being removed are tried again.
+func (q *remotePinQueue) add(cid string, name string) error {
+	if len(q.services) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, service := range q.services {
+		pin, ok := q.pins[remotePinKey(service.Name, cid)]
+		if ok && (pin.Status == ipfs.RemoteFailed || pin.Status == remoteRemoving) {
+			// a request that's still there only needs checking
+			pin.Status = remotePending
+			if pin.RequestId != "" {
+				pin.Status = ipfs.RemoteQueued
+			}
+			q.retryNow(pin)
+			continue
+		}
+		if !ok {
+			q.addLocked(service.Name, cid, name)
+		}
+	}
+
+	return q.saveAndWake()
+}
+
+// sync queues every cid that isn't known to a service yet, e.g. after a
+// service was added to the config.
+func (q *remotePinQueue) sync(pins []*pinRecord) error {
+	if len(q.services) == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, service := range q.services {
+		for _, pin := range pins {
+			if _, ok := q.pins[remotePinKey(service.Name, pin.Cid)]; !ok {
+				name := ""
+				if len(pin.Filenames) > 0 {
+					name = pin.Filenames[0]
+				}
+				q.addLocked(service.Name, pin.Cid, name)
+			}
+		}
+	}
+
+	return q.saveAndWake()
+}
+
+func (q *remotePinQueue) addLocked(service string, cid string, name string) {
+	pin := &remotePin{Service: service, Cid: cid, Name: name, Status: remotePending}
+	q.retryNow(pin)
+	q.pins[pin.key()] = pin
+}
+
+// remove queues the pins on cid to be removed from every service.
+func (q *remotePinQueue) remove(cid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	found := false
+	for _, pin := range q.pins {
+		if pin.Cid == cid {
+			pin.Status = remoteRemoving
+			q.retryNow(pin)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	return q.saveAndWake()
+}
+
+// forCid returns copies of the remote pins on cid, sorted by service.
+func (q *remotePinQueue) forCid(cid string) []*remotePin {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	pins := []*remotePin{}
+	for _, pin := range q.pins {
+		if pin.Cid == cid {
+			pinCopy := *pin
+			pins = append(pins, &pinCopy)
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Service < pins[j].Service
+	})
+
+	return pins
+}
+
+// due returns copies of the pins waiting for a request to their service.
+func (q *remotePinQueue) due() []*remotePin {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	pins := []*remotePin{}
+	for _, pin := range q.pins {
+		if !pin.settled() && !pin.NextAttempt.After(now) {
+			pinCopy := *pin
+			pins = append(pins, &pinCopy)
+		}
+	}
+
+	return pins
+}
+
+func (q *remotePinQueue) service(name string) *ipfs.RemoteClient {
+	for _, service := range q.services {
+		if service.Name == name {
+			return service
+		}
+	}
+
+	return nil
+}
+
+// retryNow resets the attempts of pin. Callers must hold mu.
+func (q *remotePinQueue) retryNow(pin *remotePin) {
+	pin.Attempts = 0
+	pin.Error = ""
+	pin.NextAttempt = time.Now().UTC()
+	pin.UpdatedAt = pin.NextAttempt
+}
+
+// saveAndWake persists the queue and wakes up the worker. Callers must
+// hold mu.
+func (q *remotePinQueue) saveAndWake() error {
+	data, err := json.Marshal(q.pins)
+	if err != nil {
+		return err
+	}
+
+	err = helper.WriteFileAtomic(q.path, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// RunRemotePinning sends the queued pin requests to the configured pinning
+// services, checks on them until they're pinned and retries the ones that
+// fail with backoff. It never returns unless no service is configured.
+func (h *Handler) RunRemotePinning() {
+	q := h.remotePins
+	if len(q.services) == 0 {
+		return
+	}
+
+	for {
+		pins := q.due()
+		// the services fetch the content from the local node
+		var origins []string
+		for _, pin := range pins {
+			if pin.Status == remotePending {
+				origins, _ = h.ipfs.Addresses()
+				break
+			}
+		}
+
+		for _, pin := range pins {
+			q.process(pin, origins)
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// process makes the next request for pin and records the outcome, unless
+// the pin changed in the meantime.
+func (q *remotePinQueue) process(pin *remotePin, origins []string) {
+	service := q.service(pin.Service)
+	if service == nil {
+		// the service was dropped from the config
+		return
+	}
+
+	var status *ipfs.RemotePinStatus
+	var err error
+	switch pin.Status {
+	case remotePending:
+		status, err = service.Add(pin.Cid, pin.Name, origins)
+	case remoteRemoving:
+		if pin.RequestId != "" {
+			err = service.Remove(pin.RequestId)
+			if ipfs.IsRemoteNotFound(err) {
+				err = nil
+			}
+		}
+	default:
+		status, err = service.Get(pin.RequestId)
+		if ipfs.IsRemoteNotFound(err) {
+			// the service lost the request, so make a new one
+			status, err = &ipfs.RemotePinStatus{Status: remotePending}, nil
+		} else if err == nil && status.Status == ipfs.RemoteFailed {
+			status, err = nil, fmt.Errorf("pin request %s failed", pin.RequestId)
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	current, ok := q.pins[pin.key()]
+	if !ok {
+		return
+	}
+	removing := current.Status == remoteRemoving
+
+	now := time.Now().UTC()
+	current.UpdatedAt = now
+	switch {
+	case err != nil:
+		current.Attempts++
+		current.Error = err.Error()
+		current.NextAttempt = now.Add(remotePinBackoff(current.Attempts))
+		if current.Attempts >= remotePinMaxAttempts {
+			log.Printf("Giving up on %s pin of %s: %s", current.Service, current.Cid, err)
+			if removing {
+				delete(q.pins, current.key())
+			} else {
+				current.Status = ipfs.RemoteFailed
+			}
+		}
+	case pin.Status == remoteRemoving:
+		if removing {
+			delete(q.pins, current.key())
+		} else {
+			// added again while being removed
+			current.RequestId = ""
+			current.Status = remotePending
+		}
+	default:
+		if status.RequestId != "" {
+			current.RequestId = status.RequestId
+		}
+		if status.Status == remotePending {
+			current.RequestId = ""
+		}
+		if !removing {
+			current.Status = status.Status
+		}
+		current.Attempts = 0
+		current.Error = ""
+		current.NextAttempt = now.Add(remotePinCheck)
+		if removing || status.Status == remotePending {
+			current.NextAttempt = now
+		}
+	}
+
+	err = q.saveAndWake()
+	if err != nil {
+		log.Printf("Couldn't save remote pins: %s", err)
+	}
+}
+
+// remotePinBackoff doubles the wait after every failed attempt, up to an
+// hour.
+func remotePinBackoff(attempts int) time.Duration {
+	backoff := 10 * time.Second << attempts
+	if attempts > 10 || backoff > time.Hour {
+		return time.Hour
+	}
+
+	return backoff
+}
@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/ipfs"
+	"github.com/sealsurlaw/gouvre/ipfs/ipfstest"
+)
+
+const testCid = "bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy"
+
+var testOrigins = []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWFake"}
+
+func newTestRemotePinQueue(t *testing.T) (*remotePinQueue, *ipfstest.PinningService, string) {
+	t.Helper()
+
+	service := ipfstest.NewPinningService("secret")
+	t.Cleanup(service.Close)
+	basePath := t.TempDir()
+	q := newRemotePinQueue(basePath, []*ipfs.RemoteClient{
+		ipfs.NewRemoteClient("fake", service.URL, "secret", time.Second),
+	})
+
+	return q, service, basePath
+}
+
+// processDue makes every pin due and processes them, the way one round of
+// RunRemotePinning does once their time has come. It returns how many
+// pins were processed.
+func processDue(q *remotePinQueue) int {
+	q.mu.Lock()
+	for _, pin := range q.pins {
+		pin.NextAttempt = time.Time{}
+	}
+	q.mu.Unlock()
+
+	pins := q.due()
+	for _, pin := range pins {
+		q.process(pin, testOrigins)
+	}
+
+	return len(pins)
+}
+
+// testPin returns the state of the pin on testCid, or nil if there's none.
+func testPin(t *testing.T, q *remotePinQueue) *remotePin {
+	t.Helper()
+
+	pins := q.forCid(testCid)
+	if len(pins) > 1 {
+		t.Fatalf("%d pins on %s, want at most 1", len(pins), testCid)
+	}
+	if len(pins) == 0 {
+		return nil
+	}
+
+	return pins[0]
+}
+
+func checkPin(t *testing.T, q *remotePinQueue, status string, attempts int) *remotePin {
+	t.Helper()
+
+	pin := testPin(t, q)
+	if pin == nil {
+		t.Fatalf("no pin on %s, want one that's %s", testCid, status)
+	}
+	if pin.Status != status || pin.Attempts != attempts {
+		t.Fatalf("pin is %s after %d attempts, want %s after %d", pin.Status, pin.Attempts, status, attempts)
+	}
+
+	return pin
+}
+
+func TestRemotePinLifecycle(t *testing.T) {
+	q, service, basePath := newTestRemotePinQueue(t)
+
+	err := q.add(testCid, "photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPin(t, q, remotePending, 0)
+
+	processDue(q)
+	pin := checkPin(t, q, ipfs.RemoteQueued, 0)
+	request := service.Request(pin.RequestId)
+	if request == nil || request.Cid != testCid || request.Name != "photo.jpg" {
+		t.Fatalf("request on the service = %+v, want photo.jpg on %s", request, testCid)
+	}
+	if len(request.Origins) != 1 || request.Origins[0] != testOrigins[0] {
+		t.Errorf("origins = %v, want %v", request.Origins, testOrigins)
+	}
+	// checked again later rather than right away
+	if until := time.Until(pin.NextAttempt); until < remotePinCheck-time.Minute/2 || until > remotePinCheck {
+		t.Errorf("next check in %s, want %s", until, remotePinCheck)
+	}
+	if n := len(q.due()); n != 0 {
+		t.Errorf("%d pins due right after being queued, want 0", n)
+	}
+
+	for _, status := range []string{ipfs.RemotePinning, ipfs.RemotePinned} {
+		service.SetStatus(pin.RequestId, status)
+		processDue(q)
+		checkPin(t, q, status, 0)
+	}
+
+	// nothing left to do once pinned
+	if n := processDue(q); n != 0 {
+		t.Errorf("%d pinned pins processed, want 0", n)
+	}
+	if n := service.Calls("POST"); n != 1 {
+		t.Errorf("%d pin requests made, want 1", n)
+	}
+
+	// the state survives a restart
+	reloaded := newRemotePinQueue(basePath, q.services)
+	checkPin(t, reloaded, ipfs.RemotePinned, 0)
+
+	err = q.remove(testCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPin(t, q, remoteRemoving, 0)
+	processDue(q)
+	if pin := testPin(t, q); pin != nil {
+		t.Errorf("pin is %s after being removed, want none", pin.Status)
+	}
+	if n := service.Requests(); n != 0 {
+		t.Errorf("%d requests left on the service, want 0", n)
+	}
+}
+
+func TestRemotePinLostByService(t *testing.T) {
+	q, service, _ := newTestRemotePinQueue(t)
+
+	_ = q.add(testCid, "photo.jpg")
+	processDue(q)
+	lost := checkPin(t, q, ipfs.RemoteQueued, 0)
+	service.Lose(lost.RequestId)
+
+	// a lost request is made again right away
+	processDue(q)
+	pin := checkPin(t, q, remotePending, 0)
+	if pin.RequestId != "" {
+		t.Errorf("request id = %q after the service lost it, want none", pin.RequestId)
+	}
+	if n := len(q.due()); n != 1 {
+		t.Errorf("%d pins due after the service lost one, want 1", n)
+	}
+
+	processDue(q)
+	pin = checkPin(t, q, ipfs.RemoteQueued, 0)
+	if pin.RequestId == "" || pin.RequestId == lost.RequestId {
+		t.Errorf("request id = %q, want a new one", pin.RequestId)
+	}
+	if service.Request(pin.RequestId) == nil {
+		t.Errorf("request %s isn't on the service", pin.RequestId)
+	}
+}
+
+func TestRemotePinRemovedDuringAdd(t *testing.T) {
+	q, service, _ := newTestRemotePinQueue(t)
+	service.OnAdd = func(cid string) {
+		_ = q.remove(cid)
+	}
+
+	_ = q.add(testCid, "photo.jpg")
+	processDue(q)
+
+	// the request the add made is kept so it can be removed
+	pin := checkPin(t, q, remoteRemoving, 0)
+	if pin.RequestId == "" || service.Request(pin.RequestId) == nil {
+		t.Fatalf("request id = %q, want the one made on the service", pin.RequestId)
+	}
+	if n := len(q.due()); n != 1 {
+		t.Errorf("%d pins due after being removed, want 1", n)
+	}
+
+	processDue(q)
+	if pin := testPin(t, q); pin != nil {
+		t.Errorf("pin is %s after being removed, want none", pin.Status)
+	}
+	if n := service.Requests(); n != 0 {
+		t.Errorf("%d requests left on the service, want 0", n)
+	}
+}
+
+func TestRemotePinGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		removing bool
+	}{
+		{name: "adding"},
+		{name: "removing", removing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, service, _ := newTestRemotePinQueue(t)
+			_ = q.add(testCid, "photo.jpg")
+			status := remotePending
+			if tt.removing {
+				processDue(q)
+				_ = q.remove(testCid)
+				status = remoteRemoving
+			}
+
+			service.FailNext(500, remotePinMaxAttempts)
+			for attempts := 1; attempts < remotePinMaxAttempts; attempts++ {
+				processDue(q)
+				pin := checkPin(t, q, status, attempts)
+				if pin.Error == "" {
+					t.Errorf("no error recorded after %d attempts", attempts)
+				}
+				backoff := remotePinBackoff(attempts)
+				if until := time.Until(pin.NextAttempt); until < backoff-time.Minute/2 || until > backoff {
+					t.Errorf("next attempt in %s after %d attempts, want %s", until, attempts, backoff)
+				}
+			}
+
+			processDue(q)
+			pin := testPin(t, q)
+			if tt.removing {
+				if pin != nil {
+					t.Errorf("pin is %s after giving up on removing it, want none", pin.Status)
+				}
+				return
+			}
+			if pin == nil || pin.Status != ipfs.RemoteFailed || pin.Attempts != remotePinMaxAttempts {
+				t.Fatalf("pin = %+v, want failed after %d attempts", pin, remotePinMaxAttempts)
+			}
+			if n := processDue(q); n != 0 {
+				t.Errorf("%d failed pins processed, want 0", n)
+			}
+		})
+	}
+}
+
+func TestRemotePinBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 20 * time.Second},
+		{attempts: 2, want: 40 * time.Second},
+		{attempts: 8, want: 2560 * time.Second},
+		{attempts: 9, want: time.Hour},
+		{attempts: 10, want: time.Hour},
+		{attempts: 64, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := remotePinBackoff(tt.attempts); got != tt.want {
+			t.Errorf("remotePinBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRemotePinRetriesFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail makes the pin fail and returns the request id it keeps
+		fail       func(q *remotePinQueue, service *ipfstest.PinningService) string
+		wantStatus string
+	}{
+		{
+			name: "add failed",
+			fail: func(q *remotePinQueue, service *ipfstest.PinningService) string {
+				service.FailNext(500, remotePinMaxAttempts)
+				return ""
+			},
+			wantStatus: remotePending,
+		},
+		{
+			name: "service failed the request",
+			fail: func(q *remotePinQueue, service *ipfstest.PinningService) string {
+				processDue(q)
+				requestId := q.forCid(testCid)[0].RequestId
+				service.SetStatus(requestId, ipfs.RemoteFailed)
+				return requestId
+			},
+			wantStatus: ipfs.RemoteQueued,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, service, _ := newTestRemotePinQueue(t)
+			_ = q.add(testCid, "photo.jpg")
+			requestId := tt.fail(q, service)
+			for i := 0; i < remotePinMaxAttempts; i++ {
+				processDue(q)
+			}
+			checkPin(t, q, ipfs.RemoteFailed, remotePinMaxAttempts)
+
+			err := q.add(testCid, "photo.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pin := checkPin(t, q, tt.wantStatus, 0)
+			if pin.Error != "" || pin.RequestId != requestId {
+				t.Errorf("pin = %+v, want no error and request id %q", pin, requestId)
+			}
+			if n := len(q.due()); n != 1 {
+				t.Errorf("%d pins due after adding again, want 1", n)
+			}
+
+			// the service pins it this time
+			if requestId != "" {
+				service.SetStatus(requestId, ipfs.RemotePinned)
+			}
+			processDue(q)
+			pin = testPin(t, q)
+			if requestId != "" {
+				checkPin(t, q, ipfs.RemotePinned, 0)
+			} else {
+				checkPin(t, q, ipfs.RemoteQueued, 0)
+				if pin.RequestId == "" {
+					t.Errorf("no request id after adding again")
+				}
+			}
+		})
+	}
+}
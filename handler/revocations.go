@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/token"
+)
+
+// revocationList remembers when the links to a stored file were revoked.
+// Links are stateless tokens, so any token for that file issued before the
+// revocation time is refused. The list is persisted in stateDir so deleted
+// files that get re-uploaded don't bring their old links back to life after
+// a restart.
+//
+// It also keeps the longest lifetime of any link issued, so a revocation is
+// dropped once every token it could refuse has expired anyway.
+type revocationList struct {
+	mu    sync.Mutex
+	path  string
+	state revocationState
+}
+
+type revocationState struct {
+	RevokedAt map[string]int64 `json:"revokedAt"`
+	// MaxLifetime is in seconds
+	MaxLifetime int64 `json:"maxLifetime"`
+}
+
+func newRevocationList(dir string) *revocationList {
+	rl := &revocationList{
+		path: fmt.Sprintf("%s/revocations.json", dir),
+	}
+
+	data, err := os.ReadFile(rl.path)
+	if err == nil {
+		err = json.Unmarshal(data, &rl.state)
+		if err != nil {
+			fmt.Printf("Couldn't parse %s: %s\n", rl.path, err)
+		}
+	}
+	if rl.state.RevokedAt == nil {
+		rl.state.RevokedAt = make(map[string]int64)
+	}
+
+	return rl
+}
+
+// coverLink records the lifetime of a link expiring at expiresAt. It must
+// be called before the link's token is issued.
+func (rl *revocationList) coverLink(expiresAt *time.Time) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	lifetime := expiresAt.Unix() - time.Now().Unix()
+	if lifetime <= rl.state.MaxLifetime {
+		return nil
+	}
+	rl.state.MaxLifetime = lifetime
+
+	return rl.saveLocked()
+}
+
+func (rl *revocationList) revoke(filenames ...string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, filename := range filenames {
+		rl.state.RevokedAt[filename] = now
+	}
+
+	return rl.saveLocked()
+}
+
+// isRevoked reports whether tokenData was issued before its file's links
+// were revoked. Tokens issued in the same second as the revocation are
+// refused too.
+func (rl *revocationList) isRevoked(tokenData *token.TokenData) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	revokedAt, ok := rl.state.RevokedAt[tokenData.Filename]
+	if !ok {
+		return false
+	}
+
+	return tokenData.IssuedAt <= revokedAt
+}
+
+// saveLocked drops the revocations whose tokens have all expired and
+// persists the list. Callers must hold mu.
+func (rl *revocationList) saveLocked() error {
+	now := time.Now().Unix()
+	for filename, revokedAt := range rl.state.RevokedAt {
+		if now > revokedAt+rl.state.MaxLifetime {
+			delete(rl.state.RevokedAt, filename)
+		}
+	}
+
+	data, err := json.Marshal(rl.state)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(rl.path, data, 0600)
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/token"
+)
+
+func TestRevocationsArePruned(t *testing.T) {
+	dir := t.TempDir()
+	rl := newRevocationList(dir)
+
+	for _, lifetime := range []time.Duration{time.Hour, time.Minute} {
+		expiresAt := time.Now().Add(lifetime)
+		err := rl.coverLink(&expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rl.state.MaxLifetime < 3599 || rl.state.MaxLifetime > 3600 {
+		t.Fatalf("max lifetime = %ds, want an hour", rl.state.MaxLifetime)
+	}
+
+	err := rl.revoke("expired.png", "live.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every link to expired.png issued before its revocation has expired
+	now := time.Now()
+	rl.state.RevokedAt["expired.png"] = now.Add(-61 * time.Minute).Unix()
+	rl.state.RevokedAt["live.png"] = now.Add(-59 * time.Minute).Unix()
+
+	err = rl.revoke("new.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the state survives a restart
+	reloaded := newRevocationList(dir)
+	if reloaded.state.MaxLifetime != rl.state.MaxLifetime {
+		t.Errorf("max lifetime = %ds after a restart, want %ds", reloaded.state.MaxLifetime, rl.state.MaxLifetime)
+	}
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{filename: "expired.png", want: false},
+		{filename: "live.png", want: true},
+		{filename: "new.png", want: true},
+	}
+	for _, tt := range tests {
+		_, kept := reloaded.state.RevokedAt[tt.filename]
+		if kept != tt.want {
+			t.Errorf("revocation of %s kept = %v, want %v", tt.filename, kept, tt.want)
+		}
+		tokenData := &token.TokenData{Filename: tt.filename, IssuedAt: now.Add(-2 * time.Hour).Unix()}
+		if got := reloaded.isRevoked(tokenData); got != tt.want {
+			t.Errorf("isRevoked(%s) = %v, want %v", tt.filename, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+// Routes returns the handler of every endpoint by pattern, including the
+// ones from IpfsRoutes.
+func (h *Handler) Routes() map[string]http.HandlerFunc {
+	routes := map[string]http.HandlerFunc{
+		"/ping":                          h.Ping,
+		"/admin/cache":                   h.GetCacheUsage,
+		"/admin/scrub":                   h.Scrub,
+		"/jobs/":                         h.GetJob,
+		"/files/upload":                  h.UploadFile,
+		"/files/":                        h.DeleteFile,
+		"/images/links/thumbnails/batch": h.CreateBatchImageThumbnailLinks,
+		"/images/links/thumbnails":       h.CreateImageThumbnailLink,
+		"/images/links/upload":           h.CreateImageUploadLink,
+		"/images/links/":                 h.GetImageFromTokenLink,
+		"/images/links":                  h.CreateImageLink,
+		"/images/uploads/":               h.UploadImageWithLink,
+		"/images/uploads":                h.UploadImage,
+		"/images/":                       h.DownloadImage,
+		"/images":                        h.ListImages,
+		"/": func(w http.ResponseWriter, r *http.Request) {
+			response.SendMethodNotFound(w)
+		},
+	}
+	for pattern, ipfsHandler := range h.IpfsRoutes() {
+		routes[pattern] = ipfsHandler
+	}
+
+	return routes
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/config"
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+)
+
+// Problems the scrubber reports for a stored original.
+const (
+	scrubMissing    = "missing"
+	scrubMismatch   = "mismatch"
+	scrubUnreadable = "unreadable"
+)
+
+// scrubProblem is a stored original that doesn't match what was uploaded.
+type scrubProblem struct {
+	storagePath string
+	filenames   []string
+	cid         string
+	problem     string
+	repaired    bool
+	err         string
+}
+
+// scrubRun is the progress of the running pass of the scrubber, or the
+// outcome of the last one.
+type scrubRun struct {
+	running      bool
+	repair       bool
+	startedAt    time.Time
+	finishedAt   time.Time
+	checked      int
+	unverifiable int
+	repaired     int
+	problems     []*scrubProblem
+	err          string
+}
+
+// RunIntegrityScrubber re-hashes every stored original once per configured
+// interval. It never returns.
+func (h *Handler) RunIntegrityScrubber() {
+	for {
+		settings := h.getScrubber()
+		interval := settings.IntervalDuration()
+		if interval == 0 {
+			// only scrubbed on request until the config sets an interval
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(interval)
+
+		run, err := h.startScrub(h.getScrubber().Repair)
+		if err != nil {
+			log.Printf("Integrity scrubber: %s", err)
+			continue
+		}
+		h.scrub(run)
+	}
+}
+
+func (h *Handler) getScrubber() config.Scrubber {
+	h.settingsMu.RLock()
+	defer h.settingsMu.RUnlock()
+
+	return *h.scrubber
+}
+
+// startScrub registers a new pass of the scrubber, unless one is running.
+func (h *Handler) startScrub(repair bool) (*scrubRun, error) {
+	h.scrubMu.Lock()
+	defer h.scrubMu.Unlock()
+
+	if h.lastScrubRun != nil && h.lastScrubRun.running {
+		return nil, errs.ErrScrubRunning
+	}
+
+	run := &scrubRun{running: true, repair: repair, startedAt: time.Now().UTC()}
+	h.lastScrubRun = run
+
+	return run, nil
+}
+
+// scrub checks every original in the index against the cid it was uploaded
+// with, or the checksum of its ciphertext when it's encrypted, and records
+// what it finds in run.
+func (h *Handler) scrub(run *scrubRun) {
+	originals, err := h.listOriginals()
+	if err != nil {
+		h.scrubMu.Lock()
+		run.running = false
+		run.finishedAt = time.Now().UTC()
+		run.err = err.Error()
+		h.scrubMu.Unlock()
+		log.Printf("Integrity scrubber: %s", err)
+		return
+	}
+
+	for _, original := range originals {
+		problem, verified := h.scrubOriginal(original, run.repair)
+
+		h.scrubMu.Lock()
+		run.checked++
+		if !verified {
+			run.unverifiable++
+		}
+		if problem != nil {
+			run.problems = append(run.problems, problem)
+			if problem.repaired {
+				run.repaired++
+			}
+		}
+		h.scrubMu.Unlock()
+	}
+
+	h.scrubMu.Lock()
+	run.running = false
+	run.finishedAt = time.Now().UTC()
+	h.scrubMu.Unlock()
+
+	fmt.Printf("Scrubbed %d originals: %d problems, %d repaired, %d unverifiable\n",
+		run.checked, len(run.problems), run.repaired, run.unverifiable)
+	for _, problem := range run.problems {
+		if !problem.repaired {
+			log.Printf("Integrity scrubber: %s of %s (%v)", problem.problem, problem.storagePath, problem.filenames)
+		}
+	}
+}
+
+// scrubbable reports whether there's anything to check record's content
+// against. Encrypted files uploaded before checksums were stored have
+// nothing.
+func scrubbable(record *index.Record) bool {
+	if record.Encrypted {
+		return record.Checksum != ""
+	}
+
+	return isBlobPath(record.StoragePath) || record.Cid != ""
+}
+
+// scrubOriginal verifies one stored original and repairs it if asked to. It
+// reports whether the original could be verified at all.
+func (h *Handler) scrubOriginal(original *cachedOriginal, repair bool) (*scrubProblem, bool) {
+	h.storageLocks.Lock(original.storagePath)
+	defer h.storageLocks.Unlock(original.storagePath)
+
+	record := h.findOriginalRecord(original)
+	if record == nil {
+		return nil, true
+	}
+	if !scrubbable(record) {
+		return nil, false
+	}
+
+	problem := &scrubProblem{
+		storagePath: original.storagePath,
+		filenames:   original.filenames,
+		cid:         record.Cid,
+	}
+	fileData, err := os.ReadFile(h.makeFullFilePath(record.StoragePath))
+	switch {
+	case os.IsNotExist(err):
+		problem.problem = scrubMissing
+	case err != nil:
+		problem.problem = scrubUnreadable
+		problem.err = err.Error()
+	case record.Encrypted && checksum(fileData) != record.Checksum:
+		problem.problem = scrubMismatch
+	case !record.Encrypted && !h.matchesUpload(fileData, record):
+		problem.problem = scrubMismatch
+	default:
+		return nil, true
+	}
+
+	if repair {
+		err = h.repairOriginal(record)
+		if err != nil {
+			problem.err = err.Error()
+		} else {
+			problem.repaired = true
+			fmt.Printf("Repaired %s from ipfs\n", original.storagePath)
+		}
+	}
+
+	return problem, true
+}
+
+// findOriginalRecord returns the record of a filename that still refers to
+// original, since they may have been replaced or deleted since they were
+// listed. Callers must hold the storage lock for the original.
+func (h *Handler) findOriginalRecord(original *cachedOriginal) *index.Record {
+	for _, filename := range original.filenames {
+		record, err := h.index.Get(filename)
+		if err == nil && record.StoragePath == original.storagePath {
+			return record
+		}
+	}
+
+	return nil
+}
+
+// matchesUpload reports whether the unencrypted fileData is what record was
+// uploaded with. Blobs are named after their raw cid; the cid in the record
+// may have been computed by the IPFS node or with the unixfs layout.
+func (h *Handler) matchesUpload(fileData []byte, record *index.Record) bool {
+	raw, err := helper.CalculateCid(fileData)
+	if err != nil {
+		return false
+	}
+	if isBlobPath(record.StoragePath) {
+		return record.StoragePath == fmt.Sprintf("%s/%s", blobsDir, raw.String())
+	}
+	if raw.String() == record.Cid {
+		return true
+	}
+
+	unixfs, err := helper.CalculateUnixfsCid(fileData)
+	return err == nil && unixfs.String() == record.Cid
+}
+
+// repairOriginal restores an unencrypted original from the IPFS node when
+// its cid is pinned there. Callers must hold the storage lock for the
+// original.
+func (h *Handler) repairOriginal(record *index.Record) error {
+	if record.Encrypted {
+		return fmt.Errorf("encrypted files can't be repaired")
+	}
+	if !h.pinToIpfs || record.Cid == "" {
+		return fmt.Errorf("no pinned copy to repair from")
+	}
+
+	pinned, err := h.ipfs.IsPinned(record.Cid)
+	if err != nil {
+		return err
+	}
+	if !pinned {
+		return fmt.Errorf("cid %s isn't pinned", record.Cid)
+	}
+
+	fileData, err := h.ipfs.Cat(record.Cid)
+	if err != nil {
+		return err
+	}
+	if !h.matchesUpload(fileData, record) {
+		return fmt.Errorf("content of cid %s doesn't match the upload", record.Cid)
+	}
+
+	err = h.createDirectories(record.StoragePath)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(h.makeFullFilePath(record.StoragePath), fileData, 0600)
+}
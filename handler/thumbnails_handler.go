@@ -2,6 +2,9 @@ package handler
 
 import (
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/request"
@@ -59,13 +62,25 @@ func (h *Handler) createThumbnailLink(w http.ResponseWriter, r *http.Request) {
 	expiresAt := request.ParseExpires(r)
 
 	thumbnailParameters := &ThumbnailParameters{req.Filename, req.Resolution, square, req.Secret}
-	thumbnailFilename, err := h.checkOrCreateThumbnailFile(thumbnailParameters)
-	if err != nil {
+	_, err = h.checkOrCreateThumbnailFile(thumbnailParameters)
+	if err == errs.ErrReservedFilename {
+		response.SendReservedFilename(w)
+		return
+	} else if err == errs.ErrBadEncryptionSecret {
+		response.SendError(w, 403, "Bad encryption secret.", err)
+		return
+	} else if err != nil {
 		response.SendError(w, 500, "Couldn't check/create thumbnail file.", err)
 		return
 	}
 
-	token, err := h.tokenizer.CreateToken(thumbnailFilename, expiresAt, req.Secret, nil)
+	err = h.revocations.coverLink(expiresAt)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
+	}
+
+	token, err := h.tokenizer.CreateFileToken(req.Filename, expiresAt, req.Secret, req.Resolution, square)
 	if err != nil {
 		response.SendError(w, 500, "Couldn't create token.", err)
 		return
@@ -100,26 +115,73 @@ func (h *Handler) createBatchThumbnailLinks(w http.ResponseWriter, r *http.Reque
 	square := request.ParseSquare(r)
 	expiresAt := request.ParseExpires(r)
 
-	filenameToUrls := make(map[string]string)
+	err = h.revocations.coverLink(expiresAt)
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
+	}
+
+	res := &response.GetThumbnailLinksResponse{
+		ExpiresAt:     expiresAt,
+		FilenameToUrl: make(map[string]string),
+		Errors:        make(map[string]*errs.ErrorResponse),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, h.getBatchParallelism())
 	for _, filename := range req.Filenames {
-		thumbnailParameters := &ThumbnailParameters{filename, req.Resolution, square, req.Secret}
-		thumbnailFilename, err := h.checkOrCreateThumbnailFile(thumbnailParameters)
-		if err != nil {
-			continue
-		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(filename string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			url, errRes := h.createBatchThumbnailLink(filename, req.Resolution, square, req.Secret, expiresAt)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if errRes != nil {
+				res.Errors[filename] = errRes
+			} else {
+				res.FilenameToUrl[filename] = url
+			}
+		}(filename)
+	}
+	wg.Wait()
 
-		token, err := h.tokenizer.CreateToken(thumbnailFilename, expiresAt, req.Secret, nil)
-		if err != nil {
-			response.SendError(w, 500, "Couldn't create token.", err)
-			return
+	response.SendJson(w, res, 200)
+}
+
+// createBatchThumbnailLink makes the thumbnail link for one file of a batch,
+// or describes why it couldn't.
+func (h *Handler) createBatchThumbnailLink(
+	filename string,
+	resolution int,
+	square bool,
+	secret string,
+	expiresAt *time.Time,
+) (string, *errs.ErrorResponse) {
+	thumbnailParameters := &ThumbnailParameters{filename, resolution, square, secret}
+	_, err := h.checkOrCreateThumbnailFile(thumbnailParameters)
+	// Gif links fall back to the original when served
+	if err != nil && err != errs.ErrGif {
+		switch {
+		case os.IsNotExist(err):
+			return "", errs.NewErrorResponse(404, "Couldn't find image.", err)
+		case err == errs.ErrReservedFilename:
+			return "", errs.NewErrorResponse(400, "Filename is reserved.", err)
+		case err == errs.ErrBadEncryptionSecret:
+			return "", errs.NewErrorResponse(403, "Bad encryption secret.", err)
+		default:
+			return "", errs.NewErrorResponse(500, "Couldn't check/create thumbnail file.", err)
 		}
+	}
 
-		url := h.makeTokenUrl(token)
-		filenameToUrls[filename] = url
+	token, err := h.tokenizer.CreateFileToken(filename, expiresAt, secret, resolution, square)
+	if err != nil {
+		return "", errs.NewErrorResponse(500, "Couldn't create token.", err)
 	}
 
-	response.SendJson(w, &response.GetThumbnailLinksResponse{
-		ExpiresAt:     expiresAt,
-		FilenameToUrl: filenameToUrls,
-	}, 200)
+	return h.makeTokenUrl(token), nil
 }
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func TestBadEncryptionSecret(t *testing.T) {
+	s := newTestServer(t, nil)
+	resp, body := s.upload(t, "/files/upload", testPng(t, 64, 48), map[string]string{
+		"filename": "photo.png",
+		"secret":   "right",
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want %d: %s", resp.StatusCode, http.StatusCreated, body)
+	}
+
+	tests := []struct {
+		name string
+		req  testRequest
+	}{
+		{
+			name: "info",
+			req:  testRequest{path: "/images/photo.png/info?secret=wrong"},
+		},
+		{
+			name: "thumbnail link",
+			req: testRequest{
+				method: http.MethodPost,
+				path:   "/images/links/thumbnails",
+				body:   `{"filename": "photo.png", "resolution": 32, "secret": "wrong"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.do(t, tt.req)
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+			}
+		})
+	}
+
+	t.Run("batch thumbnail links", func(t *testing.T) {
+		resp, body := s.do(t, testRequest{
+			method: http.MethodPost,
+			path:   "/images/links/thumbnails/batch",
+			body:   `{"filenames": ["photo.png"], "resolution": 32, "secret": "wrong"}`,
+		})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+		}
+		res := &response.GetThumbnailLinksResponse{}
+		decode(t, body, res)
+		if errRes := res.Errors["photo.png"]; errRes == nil || errRes.Code != http.StatusForbidden {
+			t.Errorf("errors = %s, want a %d for photo.png", body, http.StatusForbidden)
+		}
+	})
+}
+
+func TestThumbnailOfSharedContent(t *testing.T) {
+	s := newTestServer(t, nil)
+	photo := testPng(t, 64, 48)
+	s.uploadFile(t, "a.png", photo)
+	s.uploadFile(t, "b.png", photo)
+
+	resp, body := s.do(t, testRequest{
+		method: http.MethodPost,
+		path:   "/images/links/thumbnails",
+		body:   `{"filename": "a.png", "resolution": 32}`,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("thumbnail link status = %d, want %d: %s", resp.StatusCode, http.StatusOK, body)
+	}
+	// uploaded after the thumbnail was made
+	s.uploadFile(t, "c.png", photo)
+
+	a, err := s.h.index.Get("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Thumbnails) != 1 {
+		t.Fatalf("a.png has %d thumbnails, want 1", len(a.Thumbnails))
+	}
+	for _, filename := range []string{"b.png", "c.png"} {
+		record, err := s.h.index.Get(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.StoragePath != a.StoragePath {
+			t.Fatalf("%s is stored at %s, want %s", filename, record.StoragePath, a.StoragePath)
+		}
+		if len(record.Thumbnails) != 1 || *record.Thumbnails[0] != *a.Thumbnails[0] {
+			t.Errorf("%s thumbnails = %+v, want those of a.png", filename, record.Thumbnails)
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package handler
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/ipfs/go-cid"
-	"github.com/multiformats/go-multicodec"
-	"github.com/multiformats/go-multihash"
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/helper"
 	"github.com/sealsurlaw/gouvre/request"
@@ -64,23 +63,33 @@ func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request) {
 		response.SendError(w, 500, "Could not parse file", err)
 		return
 	}
+	uploaded := fileData
 
-	var cidStr = ""
-	pref := cid.Prefix{
-		Version:  1,
-		Codec:    uint64(multicodec.Raw),
-		MhType:   multihash.SHA2_256,
-		MhLength: -1, // default length
+	// any file can start like an image, one that doesn't parse as the
+	// image it looks like is stored unchanged
+	stripped, err := h.stripMetadata(fileData)
+	if err == nil {
+		fileData = stripped
 	}
-	cidData, err := pref.Sum(fileData)
+
+	cidData, err := helper.CalculateCidWithLayout(fileData, h.cidLayout)
+	if err != nil {
+		response.SendError(w, 500, "Could not create cid", err)
+		return
+	}
+	originalCid, err := h.originalCid(uploaded, fileData)
 	if err != nil {
 		response.SendError(w, 500, "Could not create cid", err)
 		return
 	}
-	cidStr = cidData.String()
+	cidStr := cidData.String()
 
 	// filename
 	filename, _ := request.ParseFilename(r)
+	if checkFilename(filename) != nil {
+		response.SendReservedFilename(w)
+		return
+	}
 	if filename == "" && !h.pinToIpfs {
 		if cidData.ByteLen() == 0 {
 			filename = uuid.NewString()
@@ -90,7 +99,7 @@ func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if h.pinToIpfs {
-		cidStr, err = helper.PinFile(fileData, filename)
+		cidStr, err = h.pinFile(fileData, filename)
 		if err != nil {
 			response.SendError(w, 500, "Could not pin file to IPFS", err)
 			return
@@ -103,15 +112,22 @@ func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = h.writeFile(fileData, filename, encryptionSecret)
+	meta := newFileMeta(r, filename, cidStr, encryptionSecret)
+	err = h.writeFile(fileData, encryptionSecret, meta)
 	if err != nil {
 		response.SendError(w, 500, "Could not write file", err)
 		return
 	}
 
-	res := &response.UploadImageResponse{
-		Cid: cidStr,
+	// optional queries
+	links := request.ParseLinks(r)
+
+	res, err := h.makeUploadResponse(meta, fileData, links, nil, encryptionSecret, request.ParseExpires(r))
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
 	}
+	res.OriginalCid = originalCid
 	response.SendJson(w, res, http.StatusCreated)
 }
 
@@ -129,35 +145,48 @@ func (h *Handler) uploadImage(w http.ResponseWriter, r *http.Request) {
 	// encryption-secret - optional
 	encryptionSecret := request.ParseEncryptionSecret(r)
 
+	// optional queries
+	thumbnails, err := request.ParseThumbnailResolutions(r)
+	if err != nil {
+		response.SendError(w, 400, "Invalid thumbnails.", err)
+		return
+	}
+
 	// file
 	fileData, err := request.ParseFile(r)
 	if err != nil {
 		response.SendError(w, 500, "Could not parse file", err)
 		return
 	}
+	uploaded := fileData
 
-	fileData, err = helper.AutoRotateImage(fileData)
+	// orientation stays in the EXIF data and is applied to thumbnails
+	fileData = helper.NormalizeOrientation(fileData)
+
+	fileData, err = h.stripMetadata(fileData)
 	if err != nil {
-		response.SendError(w, 500, "Could not auto-rotate image", err)
+		response.SendError(w, 400, "Malformed image.", err)
 		return
 	}
 
-	var cidStr = ""
-	pref := cid.Prefix{
-		Version:  1,
-		Codec:    uint64(multicodec.Raw),
-		MhType:   multihash.SHA2_256,
-		MhLength: -1, // default length
+	cidData, err := helper.CalculateCidWithLayout(fileData, h.cidLayout)
+	if err != nil {
+		response.SendError(w, 500, "Could not create cid", err)
+		return
 	}
-	cidData, err := pref.Sum(fileData)
+	originalCid, err := h.originalCid(uploaded, fileData)
 	if err != nil {
 		response.SendError(w, 500, "Could not create cid", err)
 		return
 	}
-	cidStr = cidData.String()
+	cidStr := cidData.String()
 
 	// filename
 	filename, _ := request.ParseFilename(r)
+	if checkFilename(filename) != nil {
+		response.SendReservedFilename(w)
+		return
+	}
 	if filename == "" && !h.pinToIpfs {
 		if cidData.ByteLen() == 0 {
 			filename = uuid.NewString()
@@ -167,7 +196,7 @@ func (h *Handler) uploadImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if h.pinToIpfs {
-		cidStr, err = helper.PinFile(fileData, filename)
+		cidStr, err = h.pinFile(fileData, filename)
 		if err != nil {
 			response.SendError(w, 500, "Could not pin file to IPFS", err)
 			return
@@ -180,15 +209,20 @@ func (h *Handler) uploadImage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = h.writeImage(fileData, filename, encryptionSecret)
+	meta := newFileMeta(r, filename, cidStr, encryptionSecret)
+	err = h.writeImage(fileData, encryptionSecret, meta)
 	if err != nil {
 		response.SendError(w, 500, "Could not write file", err)
 		return
 	}
 
-	res := &response.UploadImageResponse{
-		Cid: cidStr,
+	links := request.ParseLinks(r) || len(thumbnails) > 0
+	res, err := h.makeUploadResponse(meta, fileData, links, thumbnails, encryptionSecret, request.ParseExpires(r))
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
 	}
+	res.OriginalCid = originalCid
 	response.SendJson(w, res, http.StatusCreated)
 }
 
@@ -199,7 +233,8 @@ func (h *Handler) uploadImageWithLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !h.singleUseUploadTokens[token] {
+	// taken up front so concurrent uploads can't both use it
+	if !h.takeUploadToken(token) {
 		response.SendInvalidAuthToken(w)
 		return
 	}
@@ -222,31 +257,136 @@ func (h *Handler) uploadImageWithLink(w http.ResponseWriter, r *http.Request) {
 		response.SendError(w, 500, "Could not parse file", err)
 		return
 	}
+	uploaded := fileData
+
+	fileData, err = h.stripMetadata(fileData)
+	if err != nil {
+		response.SendError(w, 400, "Malformed image.", err)
+		return
+	}
 
-	err = h.writeImage(fileData, filename, encryptionSecret)
+	cidData, err := helper.CalculateCidWithLayout(fileData, h.cidLayout)
+	if err != nil {
+		response.SendError(w, 500, "Could not create cid", err)
+		return
+	}
+	originalCid, err := h.originalCid(uploaded, fileData)
+	if err != nil {
+		response.SendError(w, 500, "Could not create cid", err)
+		return
+	}
+
+	meta := newFileMeta(r, filename, cidData.String(), encryptionSecret)
+	err = h.writeImage(fileData, encryptionSecret, meta)
 	if err != nil {
 		response.SendError(w, 500, "Could not write file", err)
 		return
 	}
 
+	// thumbnails are made in the background so the upload returns right away
+	jobs, err := h.enqueueThumbnails(filename, resolutions, encryptionSecret)
+	if err != nil {
+		response.SendError(w, 500, "Could not queue thumbnails", err)
+		return
+	}
+
+	// optional queries
+	links := request.ParseLinks(r)
+
+	uploadRes, err := h.makeUploadResponse(meta, fileData, links, resolutions, encryptionSecret, request.ParseExpires(r))
+	if err != nil {
+		response.SendError(w, 500, "Couldn't create token.", err)
+		return
+	}
+	uploadRes.OriginalCid = originalCid
+
+	res := &response.UploadImageWithLinkResponse{
+		UploadImageResponse: uploadRes,
+		Jobs:                []*response.JobResponse{},
+	}
+	for _, job := range jobs {
+		res.Jobs = append(res.Jobs, h.makeJobResponse(job))
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	response.SendJson(w, res, http.StatusCreated)
+}
+
+// makeUploadResponse describes what was stored for an upload. With links
+// it also signs a link to the original and to the cropped and uncropped
+// thumbnail of each resolution, which are made on first use.
+func (h *Handler) makeUploadResponse(
+	meta *fileMeta,
+	fileData []byte,
+	links bool,
+	resolutions []int,
+	encryptionSecret string,
+	expiresAt *time.Time,
+) (*response.UploadImageResponse, error) {
+	res := &response.UploadImageResponse{
+		Filename:    meta.Filename,
+		Cid:         meta.Cid,
+		ContentType: http.DetectContentType(fileData),
+		Size:        len(fileData),
+		Encrypted:   meta.Encrypted,
+	}
+	res.Width, res.Height, _, _ = helper.ImageDimensions(fileData)
+
+	if !links {
+		return res, nil
+	}
+
+	err := h.revocations.coverLink(expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := h.tokenizer.CreateFileToken(meta.Filename, expiresAt, encryptionSecret, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	res.ExpiresAt = expiresAt
+	res.Url = h.makeTokenUrl(token)
+
 	for _, resolution := range resolutions {
-		// not square
-		thumbnailParameters := &ThumbnailParameters{filename, resolution, false, encryptionSecret}
-		_, err = h.checkOrCreateThumbnailFile(thumbnailParameters)
-		if err != nil {
-			continue
+		for _, cropped := range []bool{false, true} {
+			token, err := h.tokenizer.CreateFileToken(meta.Filename, expiresAt, encryptionSecret, resolution, cropped)
+			if err != nil {
+				return nil, err
+			}
+
+			res.Thumbnails = append(res.Thumbnails, &response.ThumbnailResponse{
+				Resolution: resolution,
+				Cropped:    cropped,
+				Url:        h.makeTokenUrl(token),
+			})
 		}
+	}
 
-		// square
-		thumbnailParameters = &ThumbnailParameters{filename, resolution, true, encryptionSecret}
-		_, err = h.checkOrCreateThumbnailFile(thumbnailParameters)
-		if err != nil {
-			continue
-		}
+	return res, nil
+}
+
+// uploadCidLayout is the layout of the cids uploads get. Pinned uploads get
+// the cid the node gives them, `ipfs add --cid-version=1` is UnixFS.
+func (h *Handler) uploadCidLayout() string {
+	if h.pinToIpfs {
+		return helper.CidLayoutUnixfs
 	}
 
-	delete(h.singleUseUploadTokens, token)
+	return h.cidLayout
+}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusCreated)
+// originalCid returns the cid of an upload as it was sent if what's stored
+// differs from it, and "" if it doesn't.
+func (h *Handler) originalCid(uploaded []byte, stored []byte) (string, error) {
+	if bytes.Equal(uploaded, stored) {
+		return "", nil
+	}
+
+	c, err := helper.CalculateCidWithLayout(uploaded, h.uploadCidLayout())
+	if err != nil {
+		return "", err
+	}
+
+	return c.String(), nil
 }
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"testing"
+
+	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/response"
+)
+
+func TestUploadMalformedImage(t *testing.T) {
+	s := newTestServer(t, nil)
+	// sniffs as a jpeg but its first segment runs past the end
+	fileData := []byte("\xFF\xD8\xFF\xE1\x40\x00not really a jpeg")
+
+	// generic files are stored as they are
+	s.uploadFile(t, "notes.bin", fileData)
+	resp, body := s.do(t, testRequest{path: "/images/notes.bin"})
+	if resp.StatusCode != http.StatusOK || body != string(fileData) {
+		t.Errorf("GET = %d %q, want the upload unchanged", resp.StatusCode, body)
+	}
+
+	resp, body = s.upload(t, "/images/uploads", fileData, map[string]string{"filename": "photo.jpg"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("image upload status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, body)
+	}
+}
+
+func TestUploadOriginalCid(t *testing.T) {
+	s := newTestServer(t, nil)
+	plain := testPng(t, 16, 16)
+	// a comment chunk right after the signature and IHDR
+	split := 8 + 12 + 13
+	comment := []byte("Comment\x00taken at home")
+	chunk := make([]byte, 8, 12+len(comment))
+	binary.BigEndian.PutUint32(chunk, uint32(len(comment)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, comment...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+	withComment := bytes.Join([][]byte{plain[:split], chunk, plain[split:]}, nil)
+
+	tests := []struct {
+		name            string
+		path            string
+		fileData        []byte
+		wantOriginalCid bool
+	}{
+		{name: "file with metadata", path: "/files/upload", fileData: withComment, wantOriginalCid: true},
+		{name: "image with metadata", path: "/images/uploads", fileData: withComment, wantOriginalCid: true},
+		{name: "image without metadata", path: "/images/uploads", fileData: plain},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := s.upload(t, tt.path, tt.fileData, map[string]string{"filename": fmt.Sprintf("photo%d.png", i)})
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusCreated, body)
+			}
+			res := &response.UploadImageResponse{}
+			decode(t, body, res)
+
+			storedCid, _ := helper.CalculateCid(plain)
+			if res.Cid != storedCid.String() {
+				t.Errorf("cid = %s, want %s of the stripped file", res.Cid, storedCid)
+			}
+			wantOriginalCid := ""
+			if tt.wantOriginalCid {
+				c, _ := helper.CalculateCid(tt.fileData)
+				wantOriginalCid = c.String()
+			}
+			if res.OriginalCid != wantOriginalCid {
+				t.Errorf("original cid = %q, want %q", res.OriginalCid, wantOriginalCid)
+			}
+		})
+	}
+}
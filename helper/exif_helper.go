@@ -0,0 +1,136 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	exifOrientationTag = 0x0112
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// ReadOrientation returns the EXIF orientation (1-8) of a jpeg, or 1 if the
+// file has no valid orientation tag.
+func ReadOrientation(fileData []byte) int {
+	tiffOffset := findJpegExif(fileData)
+	if tiffOffset < 0 {
+		return 1
+	}
+
+	orientation, ok := readTiffOrientation(fileData[tiffOffset:])
+	if !ok || orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+// NormalizeOrientation makes sure a jpeg's orientation can be honored by
+// every viewer without touching the image data. Pixels are never re-encoded:
+// the EXIF orientation is kept and applied when thumbnails are rendered, so a
+// correctly tagged file passes through byte-for-byte. Only an orientation
+// value outside 1-8 is rewritten in place to 1. The metadata policy may
+// still strip other EXIF data afterwards, see config.MetadataPolicy.
+func NormalizeOrientation(fileData []byte) []byte {
+	tiffOffset := findJpegExif(fileData)
+	if tiffOffset < 0 {
+		return fileData
+	}
+
+	order, valueOffset, ok := findTiffOrientation(fileData[tiffOffset:])
+	if !ok {
+		return fileData
+	}
+
+	orientation := order.Uint16(fileData[tiffOffset+valueOffset:])
+	if orientation >= 1 && orientation <= 8 {
+		return fileData
+	}
+
+	normalized := append([]byte{}, fileData...)
+	order.PutUint16(normalized[tiffOffset+valueOffset:], 1)
+
+	return normalized
+}
+
+// findJpegExif returns the offset of the TIFF payload of the first Exif APP1
+// segment, or -1 if there isn't one.
+func findJpegExif(fileData []byte) int {
+	if len(fileData) < 4 || fileData[0] != 0xFF || fileData[1] != 0xD8 {
+		return -1
+	}
+
+	pos := 2
+	for pos+4 <= len(fileData) {
+		if fileData[pos] != 0xFF {
+			return -1
+		}
+		marker := fileData[pos+1]
+		// start of scan, no more metadata segments follow
+		if marker == 0xDA || marker == 0xD9 {
+			return -1
+		}
+		length := int(binary.BigEndian.Uint16(fileData[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(fileData) {
+			return -1
+		}
+		payload := fileData[pos+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			return pos + 4 + len(exifHeader)
+		}
+		pos = end
+	}
+
+	return -1
+}
+
+func tiffByteOrder(tiff []byte) (binary.ByteOrder, bool) {
+	if len(tiff) < 8 {
+		return nil, false
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	}
+
+	return nil, false
+}
+
+func readTiffOrientation(tiff []byte) (int, bool) {
+	order, valueOffset, ok := findTiffOrientation(tiff)
+	if !ok {
+		return 0, false
+	}
+
+	return int(order.Uint16(tiff[valueOffset:])), true
+}
+
+// findTiffOrientation returns the offset of the orientation value in IFD0.
+func findTiffOrientation(tiff []byte) (binary.ByteOrder, int, bool) {
+	order, ok := tiffByteOrder(tiff)
+	if !ok {
+		return nil, 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return nil, 0, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			return order, entry + 8, true
+		}
+	}
+
+	return nil, 0, false
+}
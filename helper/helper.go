@@ -5,26 +5,20 @@ import (
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"image"
 	"image/jpeg"
 	"io/ioutil"
 	"math"
-	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
-	"strings"
 
 	"github.com/disintegration/imaging"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
 )
 
-type IpfsResponse struct {
-	Name string `json:"Name"`
-	Hash string `json:"Hash"`
-	Size string `json:"Size"`
-}
-
 func CalculateHash(str string) string {
 	s := sha512.Sum384([]byte(str))
 	return base64.URLEncoding.EncodeToString(s[:])
@@ -104,147 +98,6 @@ func OpenFile(fullFilePath string) ([]byte, error) {
 	return fileData, nil
 }
 
-func PinFile(
-	fileData []byte,
-	filename string,
-) (cid string, err error) {
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filename)
-	if err != nil {
-		return "", err
-	}
-
-	_, err = part.Write(fileData)
-	if err != nil {
-		return "", err
-	}
-
-	err = writer.Close()
-	if err != nil {
-		return "", err
-	}
-
-	req, err := http.NewRequest("POST", "http://localhost:5001/api/v0/add?cid-version=1&pin=true", body)
-	if err != nil {
-		return "", err
-	}
-
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("status code: %d", resp.StatusCode)
-	}
-
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	j := &IpfsResponse{}
-	err = json.Unmarshal(p, j)
-	if err != nil {
-		return "", err
-	}
-
-	return j.Hash, nil
-}
-
-func IsIpfsFilePinned(
-	cid string,
-) error {
-	url := "http://localhost:5001/api/v0/pin/ls"
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status code: %d", resp.StatusCode)
-	}
-
-	resBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	if !strings.Contains(string(resBody), cid) {
-		return fmt.Errorf("ipfs link not pinned locally")
-	}
-
-	return nil
-}
-
-func GetIpfsFile(
-	cid string,
-) (fileData []byte, err error) {
-	url := fmt.Sprintf("http://localhost:5001/api/v0/cat?arg=%s", cid)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status code: %d", resp.StatusCode)
-	}
-
-	fileData, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	return fileData, nil
-}
-
-func AutoRotateImage(fileData []byte) ([]byte, error) {
-	// Only jpegs have exif data
-	contentType := http.DetectContentType(fileData)
-	if contentType != "image/jpeg" {
-		return fileData, nil
-	}
-
-	// Physically rotate images with rotation exif data
-	r := bytes.NewReader(fileData)
-	img, err := imaging.Decode(r, imaging.AutoOrientation(true))
-	if err != nil {
-		return nil, err
-	}
-
-	// Turn everything back into a jpeg
-	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, img, &jpeg.Options{
-		Quality: 100,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	fileData, err = ioutil.ReadAll(buf)
-	if err != nil {
-		return nil, err
-	}
-
-	return fileData, nil
-}
-
 func cropAndScale(img image.Image, resolution int) *image.NRGBA {
 	return imaging.Fill(img, resolution, resolution, imaging.Center, imaging.Lanczos)
 }
@@ -267,3 +120,32 @@ func IsJson(s string) bool {
 	var js interface{}
 	return json.Unmarshal([]byte(s), &js) == nil
 }
+
+func CalculateCid(fileData []byte) (cid.Cid, error) {
+	pref := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.Raw),
+		MhType:   multihash.SHA2_256,
+		MhLength: -1, // default length
+	}
+
+	return pref.Sum(fileData)
+}
+
+// ImageDimensions returns the displayed width and height of an image, with
+// any EXIF orientation applied, along with the orientation itself.
+func ImageDimensions(fileData []byte) (width int, height int, orientation int, err error) {
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(fileData))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	orientation = ReadOrientation(fileData)
+	width, height = imgConfig.Width, imgConfig.Height
+	// orientations 5-8 are rotated by 90 degrees when displayed
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	return width, height, orientation, nil
+}
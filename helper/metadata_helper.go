@@ -0,0 +1,357 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+)
+
+// Kinds of embedded metadata that StripMetadata knows how to find.
+const (
+	MetadataExif    = "exif"
+	MetadataXmp     = "xmp"
+	MetadataIptc    = "iptc"
+	MetadataIcc     = "icc"
+	MetadataComment = "comment"
+)
+
+var MetadataKinds = []string{MetadataExif, MetadataXmp, MetadataIptc, MetadataIcc, MetadataComment}
+
+var MetadataFormats = []string{"jpeg", "png", "gif", "bmp"}
+
+var (
+	jpegXmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegExtendedXmpHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	jpegIptcHeader        = []byte("Photoshop 3.0\x00")
+	jpegIccHeader         = []byte("ICC_PROFILE\x00")
+	pngSignature          = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// MetadataFormat maps a detected content type to the format name used by the
+// metadata policy, or "" if the format has no metadata handling.
+func MetadataFormat(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	case "image/bmp":
+		return "bmp"
+	}
+
+	return ""
+}
+
+// StripMetadata removes every kind of embedded metadata not in keep without
+// touching the image data itself. Unknown formats are returned unchanged.
+// A jpeg's EXIF orientation survives stripping since dropping it would change
+// how the image is displayed.
+func StripMetadata(fileData []byte, keep map[string]bool) ([]byte, error) {
+	switch MetadataFormat(http.DetectContentType(fileData)) {
+	case "jpeg":
+		return stripJpegMetadata(fileData, keep)
+	case "png":
+		return stripPngMetadata(fileData, keep)
+	case "gif":
+		return stripGifMetadata(fileData, keep)
+	case "bmp":
+		return stripBmpMetadata(fileData, keep)
+	}
+
+	return fileData, nil
+}
+
+func stripJpegMetadata(fileData []byte, keep map[string]bool) ([]byte, error) {
+	if len(fileData) < 4 || fileData[0] != 0xFF || fileData[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(fileData)))
+	out.Write(fileData[:2])
+
+	pos := 2
+	for {
+		if pos+4 > len(fileData) || fileData[pos] != 0xFF {
+			return nil, fmt.Errorf("malformed jpeg segment at %d", pos)
+		}
+		marker := fileData[pos+1]
+		// fill bytes
+		if marker == 0xFF {
+			pos++
+			continue
+		}
+		// start of scan, everything after is image data
+		if marker == 0xDA || marker == 0xD9 {
+			out.Write(fileData[pos:])
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(fileData[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(fileData) {
+			return nil, fmt.Errorf("malformed jpeg segment at %d", pos)
+		}
+		payload := fileData[pos+4 : end]
+
+		kind := jpegSegmentKind(marker, payload)
+		if kind == "" || keep[kind] {
+			out.Write(fileData[pos:end])
+		} else if kind == MetadataExif {
+			orientation, ok := readTiffOrientation(payload[len(exifHeader):])
+			if ok && orientation > 1 && orientation <= 8 {
+				out.Write(makeOrientationExifSegment(orientation))
+			}
+		}
+		pos = end
+	}
+
+	return out.Bytes(), nil
+}
+
+func jpegSegmentKind(marker byte, payload []byte) string {
+	switch {
+	case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+		return MetadataExif
+	case marker == 0xE1 && bytes.HasPrefix(payload, jpegXmpHeader):
+		return MetadataXmp
+	case marker == 0xE1 && bytes.HasPrefix(payload, jpegExtendedXmpHeader):
+		return MetadataXmp
+	case marker == 0xED && bytes.HasPrefix(payload, jpegIptcHeader):
+		return MetadataIptc
+	case marker == 0xE2 && bytes.HasPrefix(payload, jpegIccHeader):
+		return MetadataIcc
+	case marker == 0xFE:
+		return MetadataComment
+	}
+
+	return ""
+}
+
+// makeOrientationExifSegment builds an APP1 segment holding an EXIF block
+// with nothing but the orientation tag.
+func makeOrientationExifSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, // big endian tiff header
+		0x00, 0x00, 0x00, 0x08, // offset of IFD0
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, // orientation, SHORT
+		0x00, 0x00, 0x00, 0x01, // count
+		0x00, byte(orientation), 0x00, 0x00, // value
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+
+	segment := []byte{0xFF, 0xE1, 0x00, 0x00}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	return append(segment, payload...)
+}
+
+func stripPngMetadata(fileData []byte, keep map[string]bool) ([]byte, error) {
+	if !bytes.HasPrefix(fileData, pngSignature) {
+		return nil, fmt.Errorf("not a png")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(fileData)))
+	out.Write(pngSignature)
+
+	pos := len(pngSignature)
+	for pos < len(fileData) {
+		if pos+12 > len(fileData) {
+			return nil, fmt.Errorf("malformed png chunk at %d", pos)
+		}
+		length := int(binary.BigEndian.Uint32(fileData[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(fileData) {
+			return nil, fmt.Errorf("malformed png chunk at %d", pos)
+		}
+		chunkType := string(fileData[pos+4 : pos+8])
+		chunkData := fileData[pos+8 : pos+8+length]
+
+		kind := pngChunkKind(chunkType, chunkData)
+		if kind == "" || keep[kind] {
+			out.Write(fileData[pos:end])
+		}
+		pos = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func pngChunkKind(chunkType string, chunkData []byte) string {
+	switch chunkType {
+	case "eXIf":
+		return MetadataExif
+	case "iCCP":
+		return MetadataIcc
+	case "tEXt", "zTXt", "iTXt":
+		keyword := chunkData
+		if i := bytes.IndexByte(chunkData, 0); i >= 0 {
+			keyword = chunkData[:i]
+		}
+		switch string(keyword) {
+		case "XML:com.adobe.xmp", "Raw profile type xmp":
+			return MetadataXmp
+		case "Raw profile type exif", "Raw profile type APP1":
+			return MetadataExif
+		case "Raw profile type iptc", "Raw profile type 8bim":
+			return MetadataIptc
+		case "Raw profile type icc", "Raw profile type icm":
+			return MetadataIcc
+		}
+		return MetadataComment
+	}
+
+	return ""
+}
+
+func stripGifMetadata(fileData []byte, keep map[string]bool) ([]byte, error) {
+	malformed := fmt.Errorf("malformed gif")
+	if len(fileData) < 13 {
+		return nil, malformed
+	}
+
+	// header, logical screen descriptor and global color table
+	pos := 13
+	if fileData[10]&0x80 != 0 {
+		pos += 3 << (fileData[10]&0x07 + 1)
+	}
+	if pos > len(fileData) {
+		return nil, malformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(fileData)))
+	out.Write(fileData[:pos])
+
+	for pos < len(fileData) {
+		start := pos
+		switch fileData[pos] {
+		case 0x3B: // trailer
+			out.Write(fileData[pos:])
+			return out.Bytes(), nil
+		case 0x2C: // image descriptor
+			if pos+10 > len(fileData) {
+				return nil, malformed
+			}
+			flags := fileData[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// lzw minimum code size
+			pos++
+			end, ok := skipGifSubBlocks(fileData, pos)
+			if !ok {
+				return nil, malformed
+			}
+			pos = end
+			out.Write(fileData[start:pos])
+		case 0x21: // extension
+			if pos+2 > len(fileData) {
+				return nil, malformed
+			}
+			label := fileData[pos+1]
+			end, ok := skipGifSubBlocks(fileData, pos+2)
+			if !ok {
+				return nil, malformed
+			}
+			pos = end
+
+			kind := gifExtensionKind(label, fileData[start+2:end])
+			if kind == "" || keep[kind] {
+				out.Write(fileData[start:end])
+			}
+		default:
+			return nil, malformed
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func skipGifSubBlocks(fileData []byte, pos int) (int, bool) {
+	for pos < len(fileData) {
+		size := int(fileData[pos])
+		pos += 1 + size
+		if size == 0 {
+			return pos, pos <= len(fileData)
+		}
+	}
+
+	return 0, false
+}
+
+func gifExtensionKind(label byte, blocks []byte) string {
+	switch label {
+	case 0xFE:
+		return MetadataComment
+	case 0xFF:
+		if len(blocks) < 12 || blocks[0] != 11 {
+			return ""
+		}
+		switch string(blocks[1:12]) {
+		case "XMP DataXMP":
+			return MetadataXmp
+		case "ICCRGBG1012":
+			return MetadataIcc
+		}
+	}
+
+	return ""
+}
+
+// stripBmpMetadata drops an embedded ICC profile from a BITMAPV5HEADER bmp,
+// which is the only metadata the format can carry.
+func stripBmpMetadata(fileData []byte, keep map[string]bool) ([]byte, error) {
+	const (
+		infoHeaderOffset  = 14
+		v5HeaderSize      = 124
+		csTypeOffset      = infoHeaderOffset + 56
+		profileDataOffset = infoHeaderOffset + 112
+		profileSizeOffset = infoHeaderOffset + 116
+		profileEmbedded   = 0x4D424544 // 'MBED'
+		profileSrgb       = 0x73524742 // 'sRGB'
+	)
+
+	if keep[MetadataIcc] || len(fileData) < infoHeaderOffset+v5HeaderSize {
+		return fileData, nil
+	}
+	if binary.LittleEndian.Uint32(fileData[infoHeaderOffset:]) != v5HeaderSize {
+		return fileData, nil
+	}
+	if binary.LittleEndian.Uint32(fileData[csTypeOffset:]) != profileEmbedded {
+		return fileData, nil
+	}
+
+	out := append([]byte{}, fileData...)
+	profileStart := infoHeaderOffset + int(binary.LittleEndian.Uint32(out[profileDataOffset:]))
+	profileEnd := profileStart + int(binary.LittleEndian.Uint32(out[profileSizeOffset:]))
+
+	binary.LittleEndian.PutUint32(out[csTypeOffset:], profileSrgb)
+	binary.LittleEndian.PutUint32(out[profileDataOffset:], 0)
+	binary.LittleEndian.PutUint32(out[profileSizeOffset:], 0)
+
+	if profileStart < infoHeaderOffset+v5HeaderSize || profileEnd > len(out) || profileEnd < profileStart {
+		return out, nil
+	}
+
+	// the profile normally trails the pixel data, drop it if so and blank
+	// it out otherwise
+	if profileEnd == len(out) {
+		out = out[:profileStart]
+		binary.LittleEndian.PutUint32(out[2:], uint32(len(out)))
+	} else {
+		for i := profileStart; i < profileEnd; i++ {
+			out[i] = 0
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,264 @@
+package helper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// defaultKeep is what the default metadata policy keeps.
+var defaultKeep = map[string]bool{MetadataIcc: true}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 8; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 64, 255})
+		}
+	}
+
+	return img
+}
+
+// tiffWithOrientation is an EXIF block holding an orientation and a GPS
+// latitude reference.
+func tiffWithOrientation(orientation int) []byte {
+	return []byte{
+		'I', 'I', 0x2A, 0x00, // little endian tiff header
+		0x08, 0x00, 0x00, 0x00, // offset of IFD0
+		0x02, 0x00, // two entries
+		0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, byte(orientation), 0x00, 0x00, 0x00,
+		0x25, 0x88, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x26, 0x00, 0x00, 0x00, // GPS IFD
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+		0x01, 0x00, // GPS IFD, one entry
+		0x01, 0x00, 0x02, 0x00, 0x02, 0x00, 0x00, 0x00, 'N', 0x00, 0x00, 0x00, // latitude ref
+		0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func jpegSegment(marker byte, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	segment := []byte{0xFF, marker, 0x00, 0x00}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(data)+2))
+
+	return append(segment, data...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], chunkType)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+
+	return append(chunk, crc...)
+}
+
+// gifExtension is an application extension with a single sub-block.
+func gifExtension(identifier string, data []byte) []byte {
+	extension := append([]byte{0x21, 0xFF, 11}, identifier...)
+	extension = append(extension, byte(len(data)))
+	extension = append(extension, data...)
+
+	return append(extension, 0x00)
+}
+
+func TestStripJpegMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encoded.Bytes()
+
+	exif := jpegSegment(0xE1, exifHeader, tiffWithOrientation(6))
+	xmp := jpegSegment(0xE1, jpegXmpHeader, []byte("<x:xmpmeta>creator</x:xmpmeta>"))
+	iptc := jpegSegment(0xED, jpegIptcHeader, []byte("8BIM\x04\x04city"))
+	icc := jpegSegment(0xE2, jpegIccHeader, []byte("\x01\x01profile"))
+	comment := jpegSegment(0xFE, []byte("taken at home"))
+	fileData := bytes.Join([][]byte{plain[:2], exif, xmp, iptc, icc, comment, plain[2:]}, nil)
+
+	got, err := StripMetadata(fileData, defaultKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Join([][]byte{plain[:2], makeOrientationExifSegment(6), icc, plain[2:]}, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("stripped jpeg = %x, want %x", got, want)
+	}
+	if o := ReadOrientation(got); o != 6 {
+		t.Errorf("orientation = %d, want 6", o)
+	}
+	checkSamePixels(t, got, plain)
+
+	// everything kept
+	got, err = StripMetadata(fileData, map[string]bool{MetadataExif: true, MetadataXmp: true, MetadataIptc: true, MetadataIcc: true, MetadataComment: true})
+	if err != nil || !bytes.Equal(got, fileData) {
+		t.Errorf("jpeg changed with every kind kept (%v)", err)
+	}
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encoded.Bytes()
+	// right after the signature and IHDR
+	split := len(pngSignature) + 12 + 13
+
+	icc := pngChunk("iCCP", []byte("profile\x00\x00compressed"))
+	fileData := bytes.Join([][]byte{
+		plain[:split],
+		pngChunk("eXIf", tiffWithOrientation(6)),
+		pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")),
+		pngChunk("zTXt", []byte("Raw profile type iptc\x00\x00data")),
+		icc,
+		pngChunk("tEXt", []byte("Comment\x00taken at home")),
+		plain[split:],
+	}, nil)
+
+	got, err := StripMetadata(fileData, defaultKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Join([][]byte{plain[:split], icc, plain[split:]}, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("stripped png = %x, want %x", got, want)
+	}
+	checkSamePixels(t, got, plain)
+}
+
+func TestStripGifMetadata(t *testing.T) {
+	var encoded bytes.Buffer
+	err := gif.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encoded.Bytes()
+	// right after the header, screen descriptor and global color table
+	split := 13
+	if plain[10]&0x80 != 0 {
+		split += 3 << (plain[10]&0x07 + 1)
+	}
+
+	icc := gifExtension("ICCRGBG1012", []byte("profile"))
+	fileData := bytes.Join([][]byte{
+		plain[:split],
+		gifExtension("XMP DataXMP", []byte("<x:xmpmeta/>")),
+		icc,
+		{0x21, 0xFE, 13}, []byte("taken at home"), {0x00},
+		plain[split:],
+	}, nil)
+
+	got, err := StripMetadata(fileData, defaultKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Join([][]byte{plain[:split], icc, plain[split:]}, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("stripped gif = %x, want %x", got, want)
+	}
+	checkSamePixels(t, got, plain)
+}
+
+func TestStripBmpMetadata(t *testing.T) {
+	const headerSize = 14 + 124
+	pixels := []byte{
+		0x00, 0x00, 0xFF, 0xFF, 0x00, 0xFF, 0x00, 0xFF,
+		0xFF, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+	}
+	profile := []byte("icc profile data")
+
+	fileData := make([]byte, headerSize)
+	copy(fileData, "BM")
+	binary.LittleEndian.PutUint32(fileData[2:], uint32(headerSize+len(pixels)+len(profile)))
+	binary.LittleEndian.PutUint32(fileData[10:], headerSize)
+	binary.LittleEndian.PutUint32(fileData[14:], 124)
+	binary.LittleEndian.PutUint32(fileData[18:], 2)  // width
+	binary.LittleEndian.PutUint32(fileData[22:], 2)  // height
+	binary.LittleEndian.PutUint16(fileData[26:], 1)  // planes
+	binary.LittleEndian.PutUint16(fileData[28:], 32) // bits per pixel
+	binary.LittleEndian.PutUint32(fileData[34:], uint32(len(pixels)))
+	binary.LittleEndian.PutUint32(fileData[70:], 0x4D424544) // embedded profile
+	binary.LittleEndian.PutUint32(fileData[126:], uint32(124+len(pixels)))
+	binary.LittleEndian.PutUint32(fileData[130:], uint32(len(profile)))
+	fileData = append(append(fileData, pixels...), profile...)
+
+	// kept by default
+	got, err := StripMetadata(fileData, defaultKeep)
+	if err != nil || !bytes.Equal(got, fileData) {
+		t.Errorf("bmp changed with icc kept (%v)", err)
+	}
+
+	got, err = StripMetadata(fileData, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != headerSize+len(pixels) || int(binary.LittleEndian.Uint32(got[2:])) != len(got) {
+		t.Errorf("stripped bmp is %d bytes, want %d", len(got), headerSize+len(pixels))
+	}
+	if !bytes.Equal(got[headerSize:], pixels) {
+		t.Errorf("pixels = %x, want %x", got[headerSize:], pixels)
+	}
+	if binary.LittleEndian.Uint32(got[70:]) != 0x73524742 || binary.LittleEndian.Uint32(got[130:]) != 0 {
+		t.Errorf("header still refers to the profile")
+	}
+}
+
+func TestStripMalformedMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileData []byte
+	}{
+		{name: "jpeg", fileData: []byte("\xFF\xD8\xFF\xE1\x40\x00truncated")},
+		{name: "png", fileData: append(append([]byte{}, pngSignature...), 0x00, 0x00, 0x01, 0x00, 'I', 'H')},
+		{name: "gif", fileData: []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00\x99")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := StripMetadata(tt.fileData, defaultKeep)
+			if err == nil {
+				t.Errorf("StripMetadata() of a malformed %s succeeded", tt.name)
+			}
+		})
+	}
+}
+
+// checkSamePixels fails if got and want don't decode to the same image.
+func checkSamePixels(t *testing.T, got []byte, want []byte) {
+	t.Helper()
+
+	gotImg, _, err := image.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("couldn't decode the stripped image: %s", err)
+	}
+	wantImg, _, err := image.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bounds := wantImg.Bounds()
+	if gotImg.Bounds() != bounds {
+		t.Fatalf("bounds = %v, want %v", gotImg.Bounds(), bounds)
+	}
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			if gotImg.At(x, y) != wantImg.At(x, y) {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, gotImg.At(x, y), wantImg.At(x, y))
+			}
+		}
+	}
+}
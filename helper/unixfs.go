@@ -0,0 +1,175 @@
+package helper
+
+import (
+	"encoding/binary"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// Layouts cids of uploads can be computed with. CidLayoutRaw hashes the
+// whole file as one raw block, CidLayoutUnixfs gives the cid an IPFS node
+// would.
+const (
+	CidLayoutRaw    = "raw"
+	CidLayoutUnixfs = "unixfs"
+)
+
+var CidLayouts = []string{CidLayoutRaw, CidLayoutUnixfs}
+
+// CalculateCidWithLayout computes the cid of fileData with one of
+// CidLayouts.
+func CalculateCidWithLayout(fileData []byte, layout string) (cid.Cid, error) {
+	if layout == CidLayoutUnixfs {
+		return CalculateUnixfsCid(fileData)
+	}
+
+	return CalculateCid(fileData)
+}
+
+// UnixFS layout used by `ipfs add --cid-version=1`: fixed size chunks
+// stored as raw leaves under a balanced tree of dag-pb nodes.
+const (
+	unixfsChunkSize = 256 * 1024
+	unixfsMaxLinks  = 174
+)
+
+// unixfsTypeFile is the UnixFS Data.Type of a file.
+const unixfsTypeFile = 2
+
+// unixfsNode is a node of a UnixFS file, with the content size under it
+// and its cumulative encoded size (Tsize) for the link to it.
+type unixfsNode struct {
+	cid      cid.Cid
+	fileSize uint64
+	tsize    uint64
+}
+
+type unixfsBuilder struct {
+	data []byte
+}
+
+// CalculateUnixfsCid returns the cid `ipfs add --cid-version=1` gives
+// fileData with the default chunker and layout, without needing a node.
+// Files of up to one chunk are a single raw block, so their cid is the
+// same as CalculateCid's.
+func CalculateUnixfsCid(fileData []byte) (cid.Cid, error) {
+	b := &unixfsBuilder{data: fileData}
+
+	root, err := b.leaf()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// every time the tree is full it becomes the first child of a new root
+	// one level deeper
+	for depth := 1; !b.done(); depth++ {
+		root, err = b.fill([]*unixfsNode{root}, depth)
+		if err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	return root.cid, nil
+}
+
+func (b *unixfsBuilder) done() bool {
+	return len(b.data) == 0
+}
+
+// leaf takes the next chunk as a raw block.
+func (b *unixfsBuilder) leaf() (*unixfsNode, error) {
+	size := unixfsChunkSize
+	if len(b.data) < size {
+		size = len(b.data)
+	}
+	chunk := b.data[:size]
+	b.data = b.data[size:]
+
+	c, err := CalculateCid(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unixfsNode{cid: c, fileSize: uint64(size), tsize: uint64(size)}, nil
+}
+
+// fill adds children of depth-1 to children until the node is full or the
+// data runs out, and returns the node.
+func (b *unixfsBuilder) fill(children []*unixfsNode, depth int) (*unixfsNode, error) {
+	for len(children) < unixfsMaxLinks && !b.done() {
+		var child *unixfsNode
+		var err error
+		if depth == 1 {
+			child, err = b.leaf()
+		} else {
+			child, err = b.fill(nil, depth-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	return b.branch(children)
+}
+
+// branch encodes a dag-pb node linking to children, with the links first
+// and unnamed as the canonical encoding has them.
+func (b *unixfsBuilder) branch(children []*unixfsNode) (*unixfsNode, error) {
+	var fileSize uint64
+	for _, child := range children {
+		fileSize += child.fileSize
+	}
+
+	// UnixFS Data: Type, filesize and one blocksizes entry per child
+	data := appendProtoVarint(nil, 1, unixfsTypeFile)
+	data = appendProtoVarint(data, 3, fileSize)
+	for _, child := range children {
+		data = appendProtoVarint(data, 4, child.fileSize)
+	}
+
+	node := []byte{}
+	tsize := uint64(0)
+	for _, child := range children {
+		link := appendProtoBytes(nil, 1, child.cid.Bytes())
+		link = appendProtoBytes(link, 2, nil)
+		link = appendProtoVarint(link, 3, child.tsize)
+		node = appendProtoBytes(node, 2, link)
+		tsize += child.tsize
+	}
+	node = appendProtoBytes(node, 1, data)
+
+	pref := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagPb),
+		MhType:   multihash.SHA2_256,
+		MhLength: -1, // default length
+	}
+	c, err := pref.Sum(node)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unixfsNode{cid: c, fileSize: fileSize, tsize: tsize + uint64(len(node))}, nil
+}
+
+// appendProtoVarint appends a protobuf varint field.
+func appendProtoVarint(buf []byte, field int, value uint64) []byte {
+	buf = appendUvarint(buf, uint64(field<<3))
+	return appendUvarint(buf, value)
+}
+
+// appendProtoBytes appends a protobuf length-delimited field.
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(buf, tmp[:n]...)
+}
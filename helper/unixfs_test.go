@@ -0,0 +1,99 @@
+package helper
+
+import (
+	"testing"
+)
+
+// testData returns size bytes of content that differs between chunks.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	return data
+}
+
+func TestCalculateUnixfsCid(t *testing.T) {
+	// The cids are those of `ipfs add --cid-version=1 --raw-leaves` for
+	// the same content, worked out with a separate encoder of its
+	// layout: raw leaves of 256 KiB under dag-pb nodes of at most 174
+	// links.
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			name: "empty",
+			data: []byte{},
+			want: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku",
+		},
+		{
+			name: "small",
+			data: []byte("hello, world"),
+			want: "bafkreiajzj7e5ktorlu4putbczyssgciqnse2b67xj6l7pcmrixaqnqnlm",
+		},
+		{
+			name: "under one chunk",
+			data: testData(100000),
+			want: "bafkreignfx3jjzbexr4wrtbx6r3vcam6lsqm2g67fzdz5jjxyoq4glxbvi",
+		},
+		{
+			name: "one chunk",
+			data: testData(unixfsChunkSize),
+			want: "bafkreibruh455iawsviqslif5c7uurdcfdemh22mtnytyzvnzn75kpejxy",
+		},
+		{
+			name: "one chunk and a byte",
+			data: testData(unixfsChunkSize + 1),
+			want: "bafybeiexg2oqkfnj56l7fcmawswqbijt5shq4b5rg6a546uwpkqqzwjioi",
+		},
+		{
+			name: "several chunks",
+			data: testData(3*unixfsChunkSize + 1000),
+			want: "bafybeibxcaffkga6wx7kvis5lrj6olydk6e7xmpcuspuptcg5tcucjbjji",
+		},
+		{
+			name: "full tree",
+			data: testData(unixfsMaxLinks * unixfsChunkSize),
+			want: "bafybeihpe5snhzneq7xs53nivmsopto5lrogo3wjynauqylqeym5a3irbm",
+		},
+		{
+			name: "depth 2",
+			data: testData((unixfsMaxLinks+1)*unixfsChunkSize + 12345),
+			want: "bafybeig26zqwrr5xvjpk3zhfgqpmhgitt3islants4x7w42yers4wromba",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CalculateUnixfsCid(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("CalculateUnixfsCid() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateCidWithLayout(t *testing.T) {
+	data := testData(unixfsChunkSize + 1)
+	raw, err := CalculateCid(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layout := range []string{CidLayoutRaw, ""} {
+		got, err := CalculateCidWithLayout(data, layout)
+		if err != nil || !got.Equals(raw) {
+			t.Errorf("CalculateCidWithLayout(%q) = %s, %v, want %s", layout, got, err, raw)
+		}
+	}
+	got, err := CalculateCidWithLayout(data, CidLayoutUnixfs)
+	if err != nil || got.String() != "bafybeiexg2oqkfnj56l7fcmawswqbijt5shq4b5rg6a546uwpkqqzwjioi" {
+		t.Errorf("CalculateCidWithLayout(unixfs) = %s, %v, want the unixfs cid", got, err)
+	}
+}
@@ -0,0 +1,341 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	filesBucket = []byte("files")
+	// refsBucket holds a "<storagePath>\x00<filename>" key for every record
+	// so references to deduplicated content can be counted by prefix.
+	refsBucket = []byte("refs")
+	// cidsBucket holds a "<cid>\x00<filename>" key for every record with a
+	// cid so files can be looked up by content.
+	cidsBucket = []byte("cids")
+)
+
+// BoltIndex is the default embedded index, a single bolt database file.
+type BoltIndex struct {
+	db *bolt.DB
+}
+
+func NewBoltIndex(path string) (*BoltIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(filesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(refsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(cidsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltIndex{
+		db: db,
+	}, nil
+}
+
+func (bi *BoltIndex) Put(record *Record) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		return bi.put(tx, record)
+	})
+}
+
+func (bi *BoltIndex) Get(filename string) (*Record, error) {
+	var record *Record
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = bi.get(tx, filename)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (bi *BoltIndex) Update(filename string, fn func(record *Record) error) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		record, err := bi.get(tx, filename)
+		if err != nil {
+			return err
+		}
+
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+
+		return bi.put(tx, record)
+	})
+}
+
+func (bi *BoltIndex) Delete(filename string) error {
+	return bi.db.Update(func(tx *bolt.Tx) error {
+		old, err := bi.get(tx, filename)
+		if err == errs.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(refsBucket).Delete(refKey(old))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(cidsBucket).Delete(cidKey(old))
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(filesBucket).Delete([]byte(filename))
+	})
+}
+
+func (bi *BoltIndex) CountReferences(storagePath string) (int, error) {
+	count := 0
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(refsBucket).Cursor()
+		prefix := []byte(storagePath + "\x00")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			count++
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+func (bi *BoltIndex) References(storagePath string) ([]string, error) {
+	filenames := []string{}
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(refsBucket).Cursor()
+		prefix := []byte(storagePath + "\x00")
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			filenames = append(filenames, string(k[len(prefix):]))
+		}
+		return nil
+	})
+
+	return filenames, err
+}
+
+func (bi *BoltIndex) FindByCid(cid string) (*Record, error) {
+	var record *Record
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(cid + "\x00")
+		k, _ := tx.Bucket(cidsBucket).Cursor().Seek(prefix)
+		if cid == "" || k == nil || !bytes.HasPrefix(k, prefix) {
+			return errs.ErrNotFound
+		}
+
+		var err error
+		record, err = bi.get(tx, string(k[len(prefix):]))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (bi *BoltIndex) List(opts *ListOptions) ([]*Record, string, error) {
+	if opts.Sort == SortFilename || opts.Sort == "" {
+		return bi.listByFilename(opts)
+	}
+
+	// other sorts need every record under the prefix
+	records := []*Record{}
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(filesBucket).Cursor()
+		prefix := []byte(opts.Prefix)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			record := &Record{}
+			err := json.Unmarshal(v, record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page(records, opts)
+}
+
+// listByFilename walks the bucket in key order, only reading one page.
+func (bi *BoltIndex) listByFilename(opts *ListOptions) ([]*Record, string, error) {
+	after := ""
+	if opts.Cursor != "" {
+		var err error
+		after, err = decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	records := []*Record{}
+	more := false
+	err := bi.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(filesBucket).Cursor()
+		prefix := []byte(opts.Prefix)
+
+		next := c.Next
+		var k, v []byte
+		if opts.Desc {
+			next = c.Prev
+			k, v = bi.seekLastWithPrefix(c, prefix)
+		} else {
+			k, v = c.Seek(prefix)
+		}
+
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = next() {
+			key := string(k)
+			if after != "" && ((!opts.Desc && key <= after) || (opts.Desc && key >= after)) {
+				continue
+			}
+			if opts.Limit > 0 && len(records) == opts.Limit {
+				more = true
+				return nil
+			}
+
+			record := &Record{}
+			err := json.Unmarshal(v, record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !more {
+		return records, "", nil
+	}
+
+	return records, encodeCursor(records[len(records)-1].Filename), nil
+}
+
+// seekLastWithPrefix positions c on the last key starting with prefix.
+func (bi *BoltIndex) seekLastWithPrefix(c *bolt.Cursor, prefix []byte) ([]byte, []byte) {
+	if len(prefix) == 0 {
+		return c.Last()
+	}
+
+	// the first key past every key with prefix is prefix with its last
+	// byte incremented, ignoring trailing 0xff bytes
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return c.Last()
+	}
+	end[len(end)-1]++
+
+	k, _ := c.Seek(end)
+	if k == nil {
+		return c.Last()
+	}
+
+	return c.Prev()
+}
+
+func (bi *BoltIndex) Len() int {
+	count := 0
+	_ = bi.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(filesBucket).Stats().KeyN
+		return nil
+	})
+
+	return count
+}
+
+func (bi *BoltIndex) Close() error {
+	return bi.db.Close()
+}
+
+func (bi *BoltIndex) get(tx *bolt.Tx, filename string) (*Record, error) {
+	data := tx.Bucket(filesBucket).Get([]byte(filename))
+	if data == nil {
+		return nil, errs.ErrNotFound
+	}
+
+	record := &Record{}
+	err := json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// put saves record and moves its reference and cid key if they changed.
+func (bi *BoltIndex) put(tx *bolt.Tx, record *Record) error {
+	refs := tx.Bucket(refsBucket)
+	cids := tx.Bucket(cidsBucket)
+	old, err := bi.get(tx, record.Filename)
+	if err == nil {
+		err = refs.Delete(refKey(old))
+		if err != nil {
+			return err
+		}
+		err = cids.Delete(cidKey(old))
+		if err != nil {
+			return err
+		}
+	} else if err != errs.ErrNotFound {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(filesBucket).Put([]byte(record.Filename), data)
+	if err != nil {
+		return err
+	}
+
+	err = refs.Put(refKey(record), []byte{})
+	if err != nil || record.Cid == "" {
+		return err
+	}
+
+	return cids.Put(cidKey(record), []byte{})
+}
+
+func refKey(record *Record) []byte {
+	return []byte(record.StoragePath + "\x00" + record.Filename)
+}
+
+func cidKey(record *Record) []byte {
+	return []byte(record.Cid + "\x00" + record.Filename)
+}
@@ -0,0 +1,170 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/helper"
+)
+
+// FileIndex keeps every record in memory and writes the whole index to a
+// single json file on each change. It's meant for small to medium stores.
+type FileIndex struct {
+	mu      sync.RWMutex
+	path    string
+	records map[string]*Record
+}
+
+func NewFileIndex(path string) (*FileIndex, error) {
+	fi := &FileIndex{
+		path:    path,
+		records: make(map[string]*Record),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fi, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &fi.records)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse index %s: %w", path, err)
+	}
+
+	return fi, nil
+}
+
+func (fi *FileIndex) Put(record *Record) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.records[record.Filename] = record
+	return fi.save()
+}
+
+func (fi *FileIndex) Get(filename string) (*Record, error) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	record, ok := fi.records[filename]
+	if !ok {
+		return nil, errs.ErrNotFound
+	}
+
+	return record, nil
+}
+
+func (fi *FileIndex) Update(filename string, fn func(record *Record) error) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	record, ok := fi.records[filename]
+	if !ok {
+		return errs.ErrNotFound
+	}
+
+	updated := *record
+	updated.Thumbnails = append([]*Thumbnail{}, record.Thumbnails...)
+	err := fn(&updated)
+	if err != nil {
+		return err
+	}
+
+	fi.records[filename] = &updated
+	return fi.save()
+}
+
+func (fi *FileIndex) Delete(filename string) error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	if _, ok := fi.records[filename]; !ok {
+		return nil
+	}
+
+	delete(fi.records, filename)
+	return fi.save()
+}
+
+func (fi *FileIndex) List(opts *ListOptions) ([]*Record, string, error) {
+	fi.mu.RLock()
+	records := make([]*Record, 0, len(fi.records))
+	for _, record := range fi.records {
+		records = append(records, record)
+	}
+	fi.mu.RUnlock()
+
+	return page(records, opts)
+}
+
+func (fi *FileIndex) CountReferences(storagePath string) (int, error) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	count := 0
+	for _, record := range fi.records {
+		if record.StoragePath == storagePath {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (fi *FileIndex) References(storagePath string) ([]string, error) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	filenames := []string{}
+	for _, record := range fi.records {
+		if record.StoragePath == storagePath {
+			filenames = append(filenames, record.Filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+func (fi *FileIndex) FindByCid(cid string) (*Record, error) {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	var found *Record
+	for _, record := range fi.records {
+		if record.Cid == cid && (found == nil || record.Filename < found.Filename) {
+			found = record
+		}
+	}
+	if found == nil {
+		return nil, errs.ErrNotFound
+	}
+
+	return found, nil
+}
+
+func (fi *FileIndex) Len() int {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+
+	return len(fi.records)
+}
+
+func (fi *FileIndex) Close() error {
+	return nil
+}
+
+func (fi *FileIndex) save() error {
+	data, err := json.Marshal(fi.records)
+	if err != nil {
+		return err
+	}
+
+	return helper.WriteFileAtomic(fi.path, data, 0600)
+}
@@ -0,0 +1,192 @@
+package index
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SortFilename   = "filename"
+	SortUploadedAt = "uploadedAt"
+	SortSize       = "size"
+)
+
+const (
+	DriverFile     = "file"
+	DriverBolt     = "bolt"
+	DriverPostgres = "postgres"
+)
+
+var Drivers = []string{DriverFile, DriverBolt, DriverPostgres}
+
+// Record describes one stored original. StoragePath is the path relative to
+// BasePath, which differs from Filename when hashFilename is enabled.
+// Content details (type and dimensions) are left empty for encrypted files,
+// which carry the Checksum of their ciphertext instead.
+type Record struct {
+	Filename    string       `json:"filename"`
+	StoragePath string       `json:"storagePath"`
+	Cid         string       `json:"cid,omitempty"`
+	ContentType string       `json:"contentType,omitempty"`
+	Size        int64        `json:"size"`
+	Width       int          `json:"width,omitempty"`
+	Height      int          `json:"height,omitempty"`
+	Encrypted   bool         `json:"encrypted"`
+	Checksum    string       `json:"checksum,omitempty"`
+	UploaderKey string       `json:"uploaderKey,omitempty"`
+	UploadedAt  time.Time    `json:"uploadedAt"`
+	UpdatedAt   time.Time    `json:"updatedAt"`
+	Thumbnails  []*Thumbnail `json:"thumbnails,omitempty"`
+}
+
+// Thumbnail is one generated variant of a Record.
+type Thumbnail struct {
+	Resolution  int    `json:"resolution"`
+	Cropped     bool   `json:"cropped"`
+	StoragePath string `json:"storagePath"`
+}
+
+// AddThumbnail records a variant unless it's already known.
+func (record *Record) AddThumbnail(thumbnail *Thumbnail) {
+	for _, t := range record.Thumbnails {
+		if t.StoragePath == thumbnail.StoragePath {
+			return
+		}
+	}
+	record.Thumbnails = append(record.Thumbnails, thumbnail)
+	record.UpdatedAt = time.Now().UTC()
+}
+
+type ListOptions struct {
+	Prefix string
+	Sort   string
+	Desc   bool
+	Cursor string
+	Limit  int
+}
+
+// Index maps original filenames to where and how they are stored.
+type Index interface {
+	Put(record *Record) error
+	Get(filename string) (*Record, error)
+	// Update atomically applies fn to the stored record and saves it.
+	Update(filename string, fn func(record *Record) error) error
+	Delete(filename string) error
+	// List returns up to opts.Limit records and a cursor for the next page,
+	// which is empty on the last page.
+	List(opts *ListOptions) ([]*Record, string, error)
+	// CountReferences returns how many records are stored at storagePath,
+	// which can be more than one for deduplicated content.
+	CountReferences(storagePath string) (int, error)
+	// References returns the filenames of the records stored at
+	// storagePath, sorted.
+	References(storagePath string) ([]string, error)
+	// FindByCid returns the record, first by filename, of a file whose
+	// content has cid, or errs.ErrNotFound.
+	FindByCid(cid string) (*Record, error)
+	Len() int
+	Close() error
+}
+
+// Open returns the index for driver. The embedded drivers keep their data
+// in dir, postgres connects to dsn.
+func Open(driver string, dsn string, dir string) (Index, error) {
+	switch driver {
+	case DriverFile:
+		return NewFileIndex(fmt.Sprintf("%s/index.json", dir))
+	case DriverBolt, "":
+		return NewBoltIndex(fmt.Sprintf("%s/index.db", dir))
+	case DriverPostgres:
+		return NewPostgresIndex(dsn)
+	}
+
+	return nil, fmt.Errorf("unknown index driver %q", driver)
+}
+
+// sortKey orders records by opts.Sort, with the filename breaking ties so
+// the order (and so the cursor) is stable.
+func sortKey(record *Record, sortBy string) string {
+	switch sortBy {
+	case SortUploadedAt:
+		return fmt.Sprintf("%020d\x00%s", record.UploadedAt.UnixNano(), record.Filename)
+	case SortSize:
+		return fmt.Sprintf("%020d\x00%s", record.Size, record.Filename)
+	}
+
+	return record.Filename
+}
+
+// splitSortKey is the inverse of sortKey for the numeric sorts.
+func splitSortKey(key string, sortBy string) (int64, string, error) {
+	if sortBy != SortUploadedAt && sortBy != SortSize {
+		return 0, key, nil
+	}
+
+	parts := strings.SplitN(key, "\x00", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid cursor")
+	}
+
+	return n, parts[1], nil
+}
+
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor")
+	}
+
+	return string(key), nil
+}
+
+// page sorts and filters records in memory according to opts.
+func page(records []*Record, opts *ListOptions) ([]*Record, string, error) {
+	after := ""
+	if opts.Cursor != "" {
+		var err error
+		after, err = decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	keyed := make(map[*Record]string)
+	matching := []*Record{}
+	for _, record := range records {
+		if !strings.HasPrefix(record.Filename, opts.Prefix) {
+			continue
+		}
+		key := sortKey(record, opts.Sort)
+		if after != "" && ((!opts.Desc && key <= after) || (opts.Desc && key >= after)) {
+			continue
+		}
+		keyed[record] = key
+		matching = append(matching, record)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if opts.Desc {
+			return keyed[matching[i]] > keyed[matching[j]]
+		}
+		return keyed[matching[i]] < keyed[matching[j]]
+	})
+
+	if opts.Limit <= 0 || len(matching) <= opts.Limit {
+		return matching, "", nil
+	}
+
+	matching = matching[:opts.Limit]
+	return matching, encodeCursor(keyed[matching[len(matching)-1]]), nil
+}
@@ -0,0 +1,264 @@
+package index
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+	"github.com/sealsurlaw/gouvre/errs"
+)
+
+var schema = []string{`
+CREATE TABLE IF NOT EXISTS gouvre_files (
+	filename     TEXT PRIMARY KEY,
+	storage_path TEXT NOT NULL,
+	cid          TEXT,
+	uploaded_at  BIGINT NOT NULL,
+	size         BIGINT NOT NULL,
+	record       JSONB NOT NULL
+)`, `
+CREATE INDEX IF NOT EXISTS gouvre_files_storage_path ON gouvre_files (storage_path)`, `
+CREATE INDEX IF NOT EXISTS gouvre_files_cid ON gouvre_files (cid)`,
+}
+
+// PostgresIndex stores records in a postgres table so several servers can
+// share one index.
+type PostgresIndex struct {
+	db *sql.DB
+}
+
+func NewPostgresIndex(dsn string) (*PostgresIndex, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%w: %s", errs.ErrCannotConnectDatabase, err)
+	}
+
+	for _, statement := range schema {
+		_, err = db.Exec(statement)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &PostgresIndex{
+		db: db,
+	}, nil
+}
+
+func (pi *PostgresIndex) Put(record *Record) error {
+	return pi.put(pi.db, record)
+}
+
+func (pi *PostgresIndex) Get(filename string) (*Record, error) {
+	return pi.get(pi.db, filename, "")
+}
+
+func (pi *PostgresIndex) Update(filename string, fn func(record *Record) error) error {
+	tx, err := pi.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	record, err := pi.get(tx, filename, "FOR UPDATE")
+	if err != nil {
+		return err
+	}
+
+	err = fn(record)
+	if err != nil {
+		return err
+	}
+
+	err = pi.put(tx, record)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pi *PostgresIndex) Delete(filename string) error {
+	_, err := pi.db.Exec(`DELETE FROM gouvre_files WHERE filename = $1`, filename)
+	return err
+}
+
+func (pi *PostgresIndex) List(opts *ListOptions) ([]*Record, string, error) {
+	column := "filename"
+	switch opts.Sort {
+	case SortUploadedAt:
+		column = "uploaded_at"
+	case SortSize:
+		column = "size"
+	}
+	direction, comparison := "ASC", ">"
+	if opts.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	query := `SELECT record FROM gouvre_files WHERE filename LIKE $1`
+	args := []interface{}{escapeLike(opts.Prefix) + "%"}
+	if opts.Cursor != "" {
+		key, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		n, filename, err := splitSortKey(key, opts.Sort)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if column == "filename" {
+			query += fmt.Sprintf(` AND filename %s $2`, comparison)
+			args = append(args, filename)
+		} else {
+			query += fmt.Sprintf(` AND (%s, filename) %s ($2, $3)`, column, comparison)
+			args = append(args, n, filename)
+		}
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, filename %s`, column, direction, direction)
+	if opts.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, opts.Limit+1)
+	}
+
+	rows, err := pi.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	records := []*Record{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, "", err
+		}
+		record := &Record{}
+		err = json.Unmarshal(data, record)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if opts.Limit <= 0 || len(records) <= opts.Limit {
+		return records, "", nil
+	}
+
+	records = records[:opts.Limit]
+	return records, encodeCursor(sortKey(records[len(records)-1], opts.Sort)), nil
+}
+
+func (pi *PostgresIndex) CountReferences(storagePath string) (int, error) {
+	count := 0
+	err := pi.db.QueryRow(`SELECT count(*) FROM gouvre_files WHERE storage_path = $1`, storagePath).Scan(&count)
+
+	return count, err
+}
+
+func (pi *PostgresIndex) References(storagePath string) ([]string, error) {
+	rows, err := pi.db.Query(`SELECT filename FROM gouvre_files WHERE storage_path = $1 ORDER BY filename`, storagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filenames := []string{}
+	for rows.Next() {
+		var filename string
+		err = rows.Scan(&filename)
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, rows.Err()
+}
+
+func (pi *PostgresIndex) FindByCid(cid string) (*Record, error) {
+	var data []byte
+	err := pi.db.QueryRow(`SELECT record FROM gouvre_files WHERE cid = $1 ORDER BY filename LIMIT 1`, cid).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errs.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &Record{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (pi *PostgresIndex) Len() int {
+	count := 0
+	_ = pi.db.QueryRow(`SELECT count(*) FROM gouvre_files`).Scan(&count)
+
+	return count
+}
+
+func (pi *PostgresIndex) Close() error {
+	return pi.db.Close()
+}
+
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (pi *PostgresIndex) put(q queryer, record *Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO gouvre_files (filename, uploaded_at, size, storage_path, cid, record)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (filename) DO UPDATE
+		SET uploaded_at = EXCLUDED.uploaded_at, size = EXCLUDED.size,
+			storage_path = EXCLUDED.storage_path, cid = EXCLUDED.cid, record = EXCLUDED.record`,
+		record.Filename, record.UploadedAt.UnixNano(), record.Size, record.StoragePath, record.Cid, data,
+	)
+
+	return err
+}
+
+func (pi *PostgresIndex) get(q queryer, filename string, lock string) (*Record, error) {
+	var data []byte
+	err := q.QueryRow(`SELECT record FROM gouvre_files WHERE filename = $1 `+lock, filename).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errs.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &Record{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
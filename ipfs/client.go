@@ -0,0 +1,489 @@
+package ipfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to the HTTP RPC API of an IPFS node such as Kubo. Requests
+// that fail to connect or find the node busy or unavailable are retried
+// with backoff. Kubo answers command errors with a 500, which isn't.
+type Client struct {
+	apiUrl     string
+	authHeader string
+	retries    int
+	httpClient *http.Client
+	// streamClient only times out waiting for headers, so large downloads
+	// aren't cut off
+	streamClient *http.Client
+	pins         *pinCache
+}
+
+// Formats content can be added in, see AddAs.
+const (
+	FormatFile    = "file"
+	FormatRaw     = "raw"
+	FormatDagJson = "dag-json"
+	FormatDagCbor = "dag-cbor"
+)
+
+var Formats = []string{FormatFile, FormatRaw, FormatDagJson, FormatDagCbor}
+
+// MaxBlockSize is the largest block nodes exchange with each other.
+const MaxBlockSize = 1 << 20
+
+type AddResponse struct {
+	Name string `json:"Name"`
+	Hash string `json:"Hash"`
+	Size string `json:"Size"`
+}
+
+// Stat describes the node at an IPFS path. Type is "file" or "directory".
+type Stat struct {
+	Hash           string `json:"Hash"`
+	Size           int64  `json:"Size"`
+	CumulativeSize int64  `json:"CumulativeSize"`
+	Type           string `json:"Type"`
+}
+
+// Link is an entry of a UnixFS directory. Type is "file" or "directory".
+type Link struct {
+	Name string `json:"name"`
+	Hash string `json:"cid"`
+	Size int64  `json:"size"`
+	Type string `json:"type"`
+}
+
+type lsResponse struct {
+	Objects []struct {
+		Hash  string `json:"Hash"`
+		Links []struct {
+			Name string `json:"Name"`
+			Hash string `json:"Hash"`
+			Size int64  `json:"Size"`
+			Type int    `json:"Type"`
+		} `json:"Links"`
+	} `json:"Objects"`
+}
+
+type blockPutResponse struct {
+	Key  string `json:"Key"`
+	Size int    `json:"Size"`
+}
+
+type dagPutResponse struct {
+	Cid struct {
+		Link string `json:"/"`
+	} `json:"Cid"`
+}
+
+type idResponse struct {
+	Addresses []string `json:"Addresses"`
+}
+
+// lsTypeDirectory is the UnixFS node type ls reports for directories.
+const lsTypeDirectory = 1
+
+type pinLsResponse struct {
+	Keys map[string]struct {
+		Type string `json:"Type"`
+	} `json:"Keys"`
+}
+
+// Error is a failed API call. Message is the node's own explanation when
+// it gave one.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"Message"`
+	Code       int    `json:"Code"`
+	Type       string `json:"Type"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ipfs: status code: %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("ipfs: %s (status code: %d)", e.Message, e.StatusCode)
+}
+
+// NewClient returns a client for the node whose API lives at apiUrl, e.g.
+// http://localhost:5001. authHeader, if set, is sent as the Authorization
+// header of every request.
+func NewClient(apiUrl, authHeader string, timeout time.Duration, retries int) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	return &Client{
+		apiUrl:       strings.TrimSuffix(apiUrl, "/"),
+		authHeader:   authHeader,
+		retries:      retries,
+		httpClient:   &http.Client{Timeout: timeout},
+		streamClient: &http.Client{Transport: transport},
+		pins:         newPinCache(),
+	}
+}
+
+// Add adds fileData as a CIDv1 UnixFS file, pins it and returns its cid.
+func (c *Client) Add(fileData []byte, filename string) (string, error) {
+	body, contentType, err := multipartFile(fileData, filename)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("cid-version", "1")
+	query.Set("pin", "true")
+	respBody, err := c.call("add", query, body, contentType)
+	if err != nil {
+		return "", err
+	}
+
+	res := &AddResponse{}
+	err = json.Unmarshal(respBody, res)
+	if err != nil {
+		return "", err
+	}
+	c.pins.set(res.Hash, true)
+
+	return res.Hash, nil
+}
+
+// AddAs adds data exactly as given in one of Formats, pins it and returns
+// its cid. FormatFile adds a UnixFS file like Add, FormatRaw a single raw
+// block of at most MaxBlockSize bytes, and the dag formats have the node
+// encode the JSON in data as a dag-json or dag-cbor node.
+func (c *Client) AddAs(data []byte, name string, format string) (string, error) {
+	if format == FormatFile {
+		return c.Add(data, name)
+	}
+
+	body, contentType, err := multipartFile(data, name)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("pin", "true")
+	var cid string
+	if format == FormatRaw {
+		query.Set("cid-codec", "raw")
+		query.Set("mhtype", "sha2-256")
+		respBody, err := c.call("block/put", query, body, contentType)
+		if err != nil {
+			return "", err
+		}
+
+		res := &blockPutResponse{}
+		err = json.Unmarshal(respBody, res)
+		if err != nil {
+			return "", err
+		}
+		cid = res.Key
+	} else {
+		query.Set("store-codec", format)
+		query.Set("input-codec", FormatDagJson)
+		query.Set("hash", "sha2-256")
+		respBody, err := c.call("dag/put", query, body, contentType)
+		if err != nil {
+			return "", err
+		}
+
+		res := &dagPutResponse{}
+		err = json.Unmarshal(respBody, res)
+		if err != nil {
+			return "", err
+		}
+		cid = res.Cid.Link
+	}
+	c.pins.set(cid, true)
+
+	return cid, nil
+}
+
+// multipartFile wraps data in the multipart body the API expects uploads
+// in, and returns it with its content type.
+func multipartFile(data []byte, filename string) ([]byte, string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = part.Write(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return body.Bytes(), writer.FormDataContentType(), nil
+}
+
+// IsPinned reports whether cid is pinned on the node. Answers are cached
+// for a while since pin checks sit in front of every gateway request.
+func (c *Client) IsPinned(cid string) (bool, error) {
+	pinned, ok := c.pins.get(cid)
+	if ok {
+		return pinned, nil
+	}
+
+	query := url.Values{}
+	query.Set("arg", cid)
+	respBody, err := c.call("pin/ls", query, nil, "")
+	if err != nil {
+		if IsNotPinned(err) {
+			c.pins.set(cid, false)
+			return false, nil
+		}
+		return false, err
+	}
+
+	res := &pinLsResponse{}
+	err = json.Unmarshal(respBody, res)
+	if err != nil {
+		return false, err
+	}
+
+	// only the requested cid can be listed, though possibly in another
+	// encoding than it was asked for
+	pinned = len(res.Keys) > 0
+	c.pins.set(cid, pinned)
+
+	return pinned, nil
+}
+
+// Cat returns the content of cid.
+func (c *Client) Cat(cid string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("arg", cid)
+
+	return c.call("cat", query, nil, "")
+}
+
+// CatStream streams length bytes of the file at ipfsPath, e.g.
+// /ipfs/{cid}/dir/file, starting at offset. A negative length reads to the
+// end. The caller closes the reader.
+func (c *Client) CatStream(ipfsPath string, offset, length int64) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("arg", ipfsPath)
+	if offset > 0 {
+		query.Set("offset", strconv.FormatInt(offset, 10))
+	}
+	if length >= 0 {
+		query.Set("length", strconv.FormatInt(length, 10))
+	}
+
+	resp, err := c.do(c.streamClient, "cat", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// DagExport streams the DAG under cid as a CARv1 file. The caller closes
+// the reader.
+func (c *Client) DagExport(cid string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("arg", cid)
+
+	resp, err := c.do(c.streamClient, "dag/export", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// DagGet returns the dag node at ipfsPath, e.g. /ipfs/{cid}, encoded as
+// codec, one of FormatDagJson and FormatDagCbor.
+func (c *Client) DagGet(ipfsPath string, codec string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("arg", ipfsPath)
+	query.Set("output-codec", codec)
+
+	return c.call("dag/get", query, nil, "")
+}
+
+// Stat describes the file or directory at ipfsPath.
+func (c *Client) Stat(ipfsPath string) (*Stat, error) {
+	query := url.Values{}
+	query.Set("arg", ipfsPath)
+	respBody, err := c.call("files/stat", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &Stat{}
+	err = json.Unmarshal(respBody, stat)
+	if err != nil {
+		return nil, err
+	}
+
+	return stat, nil
+}
+
+// Ls lists the directory at ipfsPath.
+func (c *Client) Ls(ipfsPath string) ([]*Link, error) {
+	query := url.Values{}
+	query.Set("arg", ipfsPath)
+	respBody, err := c.call("ls", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &lsResponse{}
+	err = json.Unmarshal(respBody, res)
+	if err != nil {
+		return nil, err
+	}
+
+	links := []*Link{}
+	for _, object := range res.Objects {
+		for _, l := range object.Links {
+			link := &Link{Name: l.Name, Hash: l.Hash, Size: l.Size, Type: "file"}
+			if l.Type == lsTypeDirectory {
+				link.Type = "directory"
+			}
+			links = append(links, link)
+		}
+	}
+
+	return links, nil
+}
+
+// Unpin removes the pin on cid. Unpinning a cid that isn't pinned returns
+// an error for which IsNotPinned is true.
+func (c *Client) Unpin(cid string) error {
+	query := url.Values{}
+	query.Set("arg", cid)
+
+	_, err := c.call("pin/rm", query, nil, "")
+	c.pins.forget(cid)
+
+	return err
+}
+
+// Addresses returns the multiaddrs the node can be reached at.
+func (c *Client) Addresses() ([]string, error) {
+	respBody, err := c.call("id", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &idResponse{}
+	err = json.Unmarshal(respBody, res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Addresses, nil
+}
+
+// call POSTs to an API command and returns the response body.
+func (c *Client) call(command string, query url.Values, body []byte, contentType string) ([]byte, error) {
+	resp, err := c.do(c.httpClient, command, query, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// do POSTs to an API command, retrying failed attempts, and returns the
+// response of the first one that succeeds. The caller closes its body.
+func (c *Client) do(
+	httpClient *http.Client,
+	command string,
+	query url.Values,
+	body []byte,
+	contentType string,
+) (*http.Response, error) {
+	reqUrl := fmt.Sprintf("%s/api/v0/%s", c.apiUrl, command)
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(http.MethodPost, reqUrl, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if c.authHeader != "" {
+			req.Header.Set("Authorization", c.authHeader)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		lastErr = readError(resp)
+		resp.Body.Close()
+		if !retryable(resp.StatusCode) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// IsNotPinned reports whether err is the node refusing a cid that isn't
+// pinned. Kubo reports it as a command error.
+func IsNotPinned(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && strings.Contains(apiErr.Message, "not pinned")
+}
+
+func retryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func readError(resp *http.Response) error {
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	apiErr := &Error{}
+	_ = json.Unmarshal(respBody, apiErr)
+	apiErr.StatusCode = resp.StatusCode
+
+	return apiErr
+}
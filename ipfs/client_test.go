@@ -0,0 +1,530 @@
+package ipfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/sealsurlaw/gouvre/ipfs/ipfstest"
+)
+
+func newTestClient(node *ipfstest.Node, authHeader string, retries int) *Client {
+	return NewClient(node.URL, authHeader, time.Second, retries)
+}
+
+func TestAddAs(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		codec   uint64
+		wantErr bool
+	}{
+		{name: "file", format: FormatFile, data: "hello", codec: cid.Raw},
+		{name: "raw", format: FormatRaw, data: "hello", codec: cid.Raw},
+		{name: "dag-json", format: FormatDagJson, data: `{"a":1}`, codec: cid.DagJSON},
+		{name: "dag-cbor", format: FormatDagCbor, data: `{"a":1}`, codec: cid.DagCBOR},
+		{name: "invalid json", format: FormatDagJson, data: `{"a":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := ipfstest.NewNode("")
+			defer node.Close()
+			c := newTestClient(node, "", 0)
+
+			got, err := c.AddAs([]byte(tt.data), "name", tt.format)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("AddAs() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddAs() error = %s", err)
+			}
+
+			parsed, err := cid.Decode(got)
+			if err != nil {
+				t.Fatalf("AddAs() returned a bad cid %q: %s", got, err)
+			}
+			if parsed.Prefix().Codec != tt.codec {
+				t.Errorf("codec = %x, want %x", parsed.Prefix().Codec, tt.codec)
+			}
+			if !node.IsPinned(got) {
+				t.Errorf("%s isn't pinned on the node", got)
+			}
+
+			// the pin is cached, so the node isn't asked
+			pinned, err := c.IsPinned(got)
+			if err != nil || !pinned {
+				t.Errorf("IsPinned() = %v, %v, want true", pinned, err)
+			}
+			if n := node.Requests("pin/ls"); n != 0 {
+				t.Errorf("pin/ls requests = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCode   int
+		failures     int
+		retries      int
+		wantErr      bool
+		wantRequests int
+	}{
+		{name: "no failures", statusCode: http.StatusOK, retries: 2, wantRequests: 1},
+		{name: "busy then ok", statusCode: http.StatusServiceUnavailable, failures: 2, retries: 2, wantRequests: 3},
+		{name: "rate limited then ok", statusCode: http.StatusTooManyRequests, failures: 1, retries: 1, wantRequests: 2},
+		{name: "bad gateway then ok", statusCode: http.StatusBadGateway, failures: 1, retries: 1, wantRequests: 2},
+		{name: "busy too long", statusCode: http.StatusGatewayTimeout, failures: 3, retries: 2, wantErr: true, wantRequests: 3},
+		{name: "command error", statusCode: http.StatusInternalServerError, failures: 1, retries: 2, wantErr: true, wantRequests: 1},
+		{name: "bad request", statusCode: http.StatusBadRequest, failures: 1, retries: 2, wantErr: true, wantRequests: 1},
+		{name: "no retries", statusCode: http.StatusServiceUnavailable, failures: 1, retries: 0, wantErr: true, wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := ipfstest.NewNode("")
+			defer node.Close()
+			c := newTestClient(node, "", tt.retries)
+			node.FailNext(tt.statusCode, tt.failures)
+
+			_, err := c.Addresses()
+			if tt.wantErr {
+				apiErr, ok := err.(*Error)
+				if !ok {
+					t.Fatalf("Addresses() error = %v, want an *Error", err)
+				}
+				if apiErr.StatusCode != tt.statusCode {
+					t.Errorf("StatusCode = %d, want %d", apiErr.StatusCode, tt.statusCode)
+				}
+			} else if err != nil {
+				t.Fatalf("Addresses() error = %s", err)
+			}
+			if n := node.Requests("id"); n != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestRetriesConnectionErrors(t *testing.T) {
+	var attempts int32
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&attempts, 1)
+			// hang up without answering
+			conn.Close()
+		}
+	}()
+	defer listener.Close()
+
+	c := NewClient(fmt.Sprintf("http://%s", listener.Addr()), "", time.Second, 1)
+	_, err = c.Addresses()
+	if err == nil {
+		t.Fatal("Addresses() succeeded, want an error")
+	}
+	if _, ok := err.(*Error); ok {
+		t.Errorf("Addresses() error = %v, want a connection error", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("attempts = %d, want 2", n)
+	}
+}
+
+func TestAuthHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		authHeader string
+		wantStatus int
+	}{
+		{name: "matching", authHeader: "Basic dXNlcjpwYXNz"},
+		{name: "missing", authHeader: "", wantStatus: http.StatusUnauthorized},
+		{name: "wrong", authHeader: "Basic d3Jvbmc=", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := ipfstest.NewNode("Basic dXNlcjpwYXNz")
+			defer node.Close()
+			c := newTestClient(node, tt.authHeader, 0)
+
+			_, err := c.Addresses()
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("Addresses() error = %s", err)
+				}
+				return
+			}
+			apiErr, ok := err.(*Error)
+			if !ok || apiErr.StatusCode != tt.wantStatus {
+				t.Errorf("Addresses() error = %v, want status code %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	node := ipfstest.NewNode("")
+	defer node.Close()
+	data := []byte("slow content")
+	c := node.AddFile(data)
+	node.SetDelay(200 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "too slow", timeout: 50 * time.Millisecond, wantErr: true},
+		{name: "in time", timeout: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(node.URL, "", tt.timeout, 0)
+
+			_, err := client.Cat(c)
+			checkTimeout(t, "Cat()", err, tt.wantErr)
+
+			stream, err := client.CatStream("/ipfs/"+c, 0, -1)
+			checkTimeout(t, "CatStream()", err, tt.wantErr)
+			if err == nil {
+				stream.Close()
+			}
+		})
+	}
+}
+
+func checkTimeout(t *testing.T, call string, err error, wantErr bool) {
+	t.Helper()
+
+	if !wantErr {
+		if err != nil {
+			t.Errorf("%s error = %s", call, err)
+		}
+		return
+	}
+
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Errorf("%s error = %v, want a timeout", call, err)
+	}
+}
+
+func TestIsPinned(t *testing.T) {
+	node := ipfstest.NewNode("")
+	defer node.Close()
+	pinned := node.AddFile([]byte("pinned"))
+	node.Pin(pinned)
+	unpinned := node.AddFile([]byte("unpinned"))
+
+	tests := []struct {
+		name    string
+		cid     string
+		want    bool
+		wantErr bool
+		failure int
+	}{
+		{name: "pinned", cid: pinned, want: true},
+		{name: "not pinned", cid: unpinned, want: false},
+		{name: "node error", cid: pinned, failure: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(node, "", 0)
+			if tt.failure != 0 {
+				node.FailNext(tt.failure, 1)
+			}
+
+			got, err := c.IsPinned(tt.cid)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("IsPinned() = %v, want an error", got)
+				}
+				// errors aren't cached
+				if _, ok := c.pins.get(tt.cid); ok {
+					t.Errorf("failed pin check was cached")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("IsPinned() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsPinned() = %v, want %v", got, tt.want)
+			}
+
+			before := node.Requests("pin/ls")
+			got, err = c.IsPinned(tt.cid)
+			if err != nil || got != tt.want {
+				t.Errorf("cached IsPinned() = %v, %v, want %v", got, err, tt.want)
+			}
+			if n := node.Requests("pin/ls") - before; n != 0 {
+				t.Errorf("pin/ls requests for a cached answer = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestIsPinnedParsesKeys(t *testing.T) {
+	v0 := "QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n"
+	parsed, err := cid.Decode(v0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := cid.NewCidV1(cid.DagProtobuf, parsed.Hash()).String()
+
+	tests := []struct {
+		name    string
+		body    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "same encoding", body: fmt.Sprintf(`{"Keys":{"%s":{"Type":"recursive"}}}`, v1), want: true},
+		{name: "other encoding", body: fmt.Sprintf(`{"Keys":{"%s":{"Type":"recursive"}}}`, v0), want: true},
+		{name: "no keys", body: `{"Keys":{}}`, want: false},
+		{name: "garbage", body: `{"Keys":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotArg string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotArg = r.URL.Query().Get("arg")
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			c := NewClient(server.URL, "", time.Second, 0)
+			got, err := c.IsPinned(v1)
+			if gotArg != v1 {
+				t.Errorf("pin/ls arg = %q, want %q", gotArg, v1)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("IsPinned() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("IsPinned() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsPinned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnpin(t *testing.T) {
+	node := ipfstest.NewNode("")
+	defer node.Close()
+	c := newTestClient(node, "", 0)
+
+	cid, err := c.Add([]byte("content"), "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Unpin(cid)
+	if err != nil {
+		t.Fatalf("Unpin() error = %s", err)
+	}
+	if node.IsPinned(cid) {
+		t.Errorf("%s is still pinned on the node", cid)
+	}
+	if _, ok := c.pins.get(cid); ok {
+		t.Errorf("pin of %s is still cached", cid)
+	}
+
+	err = c.Unpin(cid)
+	if !IsNotPinned(err) {
+		t.Errorf("second Unpin() error = %v, want a not pinned error", err)
+	}
+}
+
+func TestIsNotPinned(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "pin/ls", err: &Error{StatusCode: 500, Message: "path 'bafy' is not pinned"}, want: true},
+		{name: "pin/rm", err: &Error{StatusCode: 500, Message: "not pinned or pinned indirectly"}, want: true},
+		{name: "other command error", err: &Error{StatusCode: 500, Message: "block not found"}},
+		{name: "status only", err: &Error{StatusCode: 503}},
+		{name: "other error", err: errors.New("not pinned")},
+		{name: "nil", err: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsNotPinned(tt.err); got != tt.want {
+				t.Errorf("IsNotPinned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatStream(t *testing.T) {
+	node := ipfstest.NewNode("")
+	defer node.Close()
+	c := newTestClient(node, "", 0)
+	file := node.AddFile([]byte("0123456789"))
+	dir := node.AddDirectory(map[string]string{"digits.txt": file})
+
+	tests := []struct {
+		name   string
+		path   string
+		offset int64
+		length int64
+		want   string
+	}{
+		{name: "whole file", path: "/ipfs/" + file, length: -1, want: "0123456789"},
+		{name: "offset", path: "/ipfs/" + file, offset: 4, length: -1, want: "456789"},
+		{name: "range", path: "/ipfs/" + file, offset: 2, length: 3, want: "234"},
+		{name: "in directory", path: fmt.Sprintf("/ipfs/%s/digits.txt", dir), length: 2, want: "01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := c.CatStream(tt.path, tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("CatStream() error = %s", err)
+			}
+			defer stream.Close()
+
+			got, err := ioutil.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("CatStream() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatAndLs(t *testing.T) {
+	node := ipfstest.NewNode("")
+	defer node.Close()
+	c := newTestClient(node, "", 0)
+	file := node.AddFile([]byte("hello"))
+	sub := node.AddDirectory(map[string]string{})
+	dir := node.AddDirectory(map[string]string{"hello.txt": file, "sub": sub})
+
+	stat, err := c.Stat("/ipfs/" + dir)
+	if err != nil {
+		t.Fatalf("Stat() error = %s", err)
+	}
+	if stat.Type != "directory" || stat.Hash != dir {
+		t.Errorf("Stat() = %+v, want directory %s", stat, dir)
+	}
+
+	stat, err = c.Stat(fmt.Sprintf("/ipfs/%s/hello.txt", dir))
+	if err != nil {
+		t.Fatalf("Stat() error = %s", err)
+	}
+	if stat.Type != "file" || stat.Size != 5 {
+		t.Errorf("Stat() = %+v, want a file of 5 bytes", stat)
+	}
+
+	links, err := c.Ls("/ipfs/" + dir)
+	if err != nil {
+		t.Fatalf("Ls() error = %s", err)
+	}
+	want := []Link{
+		{Name: "hello.txt", Hash: file, Size: 5, Type: "file"},
+		{Name: "sub", Hash: sub, Type: "directory"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("Ls() returned %d links, want %d", len(links), len(want))
+	}
+	for i, link := range links {
+		if *link != want[i] {
+			t.Errorf("link %d = %+v, want %+v", i, *link, want[i])
+		}
+	}
+}
+
+func TestPinCacheTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		pinned     bool
+		after      time.Duration
+		wantCached bool
+	}{
+		{name: "pinned, fresh", pinned: true, after: pinnedTTL - time.Second, wantCached: true},
+		{name: "pinned, expired", pinned: true, after: pinnedTTL + time.Second},
+		{name: "not pinned, fresh", pinned: false, after: notPinnedTTL - time.Second, wantCached: true},
+		{name: "not pinned, expired", pinned: false, after: notPinnedTTL + time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			pc := newPinCache()
+			pc.now = func() time.Time { return now }
+
+			pc.set("cid", tt.pinned)
+			now = now.Add(tt.after)
+
+			pinned, ok := pc.get("cid")
+			if ok != tt.wantCached {
+				t.Fatalf("get() cached = %v, want %v", ok, tt.wantCached)
+			}
+			if ok && pinned != tt.pinned {
+				t.Errorf("get() = %v, want %v", pinned, tt.pinned)
+			}
+		})
+	}
+}
+
+func TestPinCacheFull(t *testing.T) {
+	now := time.Now()
+	pc := newPinCache()
+	pc.now = func() time.Time { return now }
+
+	// expired entries make room first
+	for i := 0; i < maxPinCache; i++ {
+		pc.set(fmt.Sprintf("expired-%d", i), false)
+	}
+	now = now.Add(notPinnedTTL + time.Second)
+	pc.set("live", true)
+	if len(pc.entries) != 1 {
+		t.Errorf("entries after evicting expired ones = %d, want 1", len(pc.entries))
+	}
+
+	// a cache full of live entries starts over
+	for i := 1; i < maxPinCache; i++ {
+		pc.set(fmt.Sprintf("live-%d", i), true)
+	}
+	pc.set("new", true)
+	if len(pc.entries) != 1 {
+		t.Errorf("entries after starting over = %d, want 1", len(pc.entries))
+	}
+	if pinned, ok := pc.get("new"); !ok || !pinned {
+		t.Errorf("get() of the newest entry = %v, %v, want true, true", pinned, ok)
+	}
+}
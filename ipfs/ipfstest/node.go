@@ -0,0 +1,406 @@
+// Package ipfstest provides in-process fakes of an IPFS node and of a
+// pinning service for tests.
+package ipfstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// Node is a fake of the HTTP RPC API of Kubo that keeps its content in
+// memory. It answers the commands the ipfs package uses the way Kubo does,
+// including reporting command errors with a 500.
+type Node struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	authHeader string
+	files      map[string][]byte
+	dirs       map[string]map[string]string
+	pins       map[string]bool
+	requests   map[string]int
+	failures   []int
+	delay      time.Duration
+}
+
+// NewNode starts a fake node. If authHeader is set, requests without it as
+// their Authorization header are refused with a 401. Close it when done.
+func NewNode(authHeader string) *Node {
+	n := &Node{
+		authHeader: authHeader,
+		files:      make(map[string][]byte),
+		dirs:       make(map[string]map[string]string),
+		pins:       make(map[string]bool),
+		requests:   make(map[string]int),
+	}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+
+	return n
+}
+
+// AddFile stores data without pinning it and returns its cid.
+func (n *Node) AddFile(data []byte) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.addFileLocked(data, multicodec.Raw)
+}
+
+// AddDag stores the JSON in data as a dag node of codec, dag-json or
+// dag-cbor, without pinning it and returns its cid. Like dag/put, it keeps
+// the JSON as is rather than encoding it.
+func (n *Node) AddDag(data []byte, codec multicodec.Code) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.addFileLocked(data, codec)
+}
+
+// AddDirectory stores a directory of the given entries, mapping names to
+// cids, without pinning it and returns its cid.
+func (n *Node) AddDirectory(entries map[string]string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var listing strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&listing, "%s %s\n", name, entries[name])
+	}
+
+	c := sum([]byte(listing.String()), multicodec.DagPb)
+	n.dirs[c] = entries
+
+	return c
+}
+
+// Pin pins cid.
+func (n *Node) Pin(cid string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pins[cid] = true
+}
+
+// Unpin removes the pin on cid.
+func (n *Node) Unpin(cid string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.pins, cid)
+}
+
+// IsPinned reports whether cid is pinned.
+func (n *Node) IsPinned(cid string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.pins[cid]
+}
+
+// Requests returns how many requests were made for command, e.g. "pin/ls",
+// including the ones that failed.
+func (n *Node) Requests(command string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.requests[command]
+}
+
+// FailNext answers the next count requests with statusCode.
+func (n *Node) FailNext(statusCode int, count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		n.failures = append(n.failures, statusCode)
+	}
+}
+
+// SetDelay makes the node wait before answering every request.
+func (n *Node) SetDelay(delay time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.delay = delay
+}
+
+func (n *Node) serve(w http.ResponseWriter, r *http.Request) {
+	command := strings.TrimPrefix(r.URL.Path, "/api/v0/")
+
+	n.mu.Lock()
+	n.requests[command]++
+	delay := n.delay
+	failure := 0
+	if len(n.failures) > 0 {
+		failure = n.failures[0]
+		n.failures = n.failures[1:]
+	}
+	n.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if n.authHeader != "" && r.Header.Get("Authorization") != n.authHeader {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if failure != 0 {
+		sendError(w, failure, "injected failure")
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	query := r.URL.Query()
+	switch command {
+	case "add":
+		data, ok := readFile(w, r)
+		if !ok {
+			return
+		}
+		c := n.addFileLocked(data, multicodec.Raw)
+		if query.Get("pin") != "false" {
+			n.pins[c] = true
+		}
+		sendJson(w, map[string]string{"Name": c, "Hash": c, "Size": strconv.Itoa(len(data))})
+	case "block/put", "dag/put":
+		data, ok := readFile(w, r)
+		if !ok {
+			return
+		}
+		codec := multicodec.Raw
+		switch query.Get("cid-codec") + query.Get("store-codec") {
+		case "dag-json":
+			codec = multicodec.DagJson
+		case "dag-cbor":
+			codec = multicodec.DagCbor
+		}
+		if codec != multicodec.Raw {
+			var v interface{}
+			if json.Unmarshal(data, &v) != nil {
+				sendError(w, http.StatusInternalServerError, "failed to decode dag-json input")
+				return
+			}
+		}
+		c := n.addFileLocked(data, codec)
+		if query.Get("pin") == "true" {
+			n.pins[c] = true
+		}
+		if command == "block/put" {
+			sendJson(w, map[string]interface{}{"Key": c, "Size": len(data)})
+		} else {
+			sendJson(w, map[string]interface{}{"Cid": map[string]string{"/": c}})
+		}
+	case "dag/get":
+		c, ok := n.resolve(query.Get("arg"))
+		if !ok {
+			sendError(w, http.StatusInternalServerError, "block not found")
+			return
+		}
+		// not re-encoded as output-codec, the stored node is all there is
+		_, _ = w.Write(n.files[c])
+	case "pin/ls":
+		keys := map[string]interface{}{}
+		if arg := query.Get("arg"); arg != "" {
+			if !n.pins[arg] {
+				sendError(w, http.StatusInternalServerError, fmt.Sprintf("path '%s' is not pinned", arg))
+				return
+			}
+			keys[arg] = map[string]string{"Type": "recursive"}
+		} else {
+			for c := range n.pins {
+				keys[c] = map[string]string{"Type": "recursive"}
+			}
+		}
+		sendJson(w, map[string]interface{}{"Keys": keys})
+	case "pin/rm":
+		arg := query.Get("arg")
+		if !n.pins[arg] {
+			sendError(w, http.StatusInternalServerError, "not pinned or pinned indirectly")
+			return
+		}
+		delete(n.pins, arg)
+		sendJson(w, map[string]interface{}{"Pins": []string{arg}})
+	case "cat":
+		c, ok := n.resolve(query.Get("arg"))
+		data, isFile := n.files[c]
+		if !ok || !isFile {
+			sendError(w, http.StatusInternalServerError, "no link named")
+			return
+		}
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		if offset > len(data) {
+			offset = len(data)
+		}
+		data = data[offset:]
+		if length := query.Get("length"); length != "" {
+			l, _ := strconv.Atoi(length)
+			if l < len(data) {
+				data = data[:l]
+			}
+		}
+		_, _ = w.Write(data)
+	case "files/stat":
+		c, ok := n.resolve(query.Get("arg"))
+		if !ok {
+			sendError(w, http.StatusInternalServerError, "no link named")
+			return
+		}
+		if _, isDir := n.dirs[c]; isDir {
+			sendJson(w, map[string]interface{}{"Hash": c, "Size": 0, "CumulativeSize": 0, "Type": "directory"})
+			return
+		}
+		sendJson(w, map[string]interface{}{
+			"Hash":           c,
+			"Size":           len(n.files[c]),
+			"CumulativeSize": len(n.files[c]),
+			"Type":           "file",
+		})
+	case "ls":
+		c, ok := n.resolve(query.Get("arg"))
+		entries, isDir := n.dirs[c]
+		if !ok || !isDir {
+			sendError(w, http.StatusInternalServerError, "not a directory")
+			return
+		}
+		links := []map[string]interface{}{}
+		for name, entry := range entries {
+			// 1 is a directory, 2 a file
+			linkType := 2
+			if _, ok := n.dirs[entry]; ok {
+				linkType = 1
+			}
+			links = append(links, map[string]interface{}{
+				"Name": name,
+				"Hash": entry,
+				"Size": len(n.files[entry]),
+				"Type": linkType,
+			})
+		}
+		sort.Slice(links, func(i, j int) bool {
+			return links[i]["Name"].(string) < links[j]["Name"].(string)
+		})
+		sendJson(w, map[string]interface{}{"Objects": []interface{}{
+			map[string]interface{}{"Hash": c, "Links": links},
+		}})
+	case "dag/export":
+		c, ok := n.resolve(query.Get("arg"))
+		if !ok {
+			sendError(w, http.StatusInternalServerError, "block not found")
+			return
+		}
+		// not a real CAR, but enough to tell what was exported
+		_, _ = fmt.Fprintf(w, "CARv1 %s", c)
+	case "id":
+		sendJson(w, map[string]interface{}{
+			"ID":        "12D3KooWFake",
+			"Addresses": []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWFake"},
+		})
+	default:
+		sendError(w, http.StatusNotFound, "unknown command")
+	}
+}
+
+// addFileLocked stores data as a block of codec. Callers must hold mu.
+func (n *Node) addFileLocked(data []byte, codec multicodec.Code) string {
+	c := sum(data, codec)
+	n.files[c] = data
+
+	return c
+}
+
+// resolve returns the cid an IPFS path such as /ipfs/{cid}/dir/file or a
+// plain cid refers to. Callers must hold mu.
+func (n *Node) resolve(ipfsPath string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(strings.Trim(ipfsPath, "/"), "ipfs/"), "/")
+	c := parts[0]
+	for _, name := range parts[1:] {
+		entry, ok := n.dirs[c][name]
+		if !ok {
+			return "", false
+		}
+		c = entry
+	}
+
+	_, isFile := n.files[c]
+	_, isDir := n.dirs[c]
+
+	return c, isFile || isDir
+}
+
+func sum(data []byte, codec multicodec.Code) string {
+	pref := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(codec),
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}
+	c, err := pref.Sum(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return c.String()
+}
+
+// readFile reads the first file of a multipart upload. Like Kubo, it
+// doesn't require the part to have a filename.
+func readFile(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "file argument 'path' is required")
+		return nil, false
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "file argument 'path' is required")
+		return nil, false
+	}
+	defer part.Close()
+
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	return data, true
+}
+
+func sendJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// sendError answers like Kubo does when a command fails.
+func sendError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"Message": message,
+		"Code":    0,
+		"Type":    "error",
+	})
+}
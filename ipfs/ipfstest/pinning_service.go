@@ -0,0 +1,218 @@
+package ipfstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PinRequest is a pin request as the fake pinning service keeps it.
+type PinRequest struct {
+	RequestId string
+	Status    string
+	Cid       string
+	Name      string
+	Origins   []string
+}
+
+// PinningService is a fake of a service implementing the IPFS Pinning
+// Service API. New requests are queued and only change status when a test
+// says so.
+type PinningService struct {
+	*httptest.Server
+
+	// OnAdd, if set, is called while a pin request is being added, before
+	// the service answers.
+	OnAdd func(cid string)
+
+	mu       sync.Mutex
+	token    string
+	requests map[string]*PinRequest
+	nextId   int
+	calls    map[string]int
+	failures []int
+}
+
+// NewPinningService starts a fake pinning service that accepts token as
+// its bearer token. Close it when done.
+func NewPinningService(token string) *PinningService {
+	s := &PinningService{
+		token:    token,
+		requests: make(map[string]*PinRequest),
+		calls:    make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	return s
+}
+
+// Request returns a copy of the pin request requestId, or nil if the
+// service doesn't know it.
+func (s *PinningService) Request(requestId string) *PinRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	request, ok := s.requests[requestId]
+	if !ok {
+		return nil
+	}
+	requestCopy := *request
+
+	return &requestCopy
+}
+
+// Requests returns how many pin requests the service knows.
+func (s *PinningService) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.requests)
+}
+
+// SetStatus changes the status of the pin request requestId.
+func (s *PinningService) SetStatus(requestId string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if request, ok := s.requests[requestId]; ok {
+		request.Status = status
+	}
+}
+
+// Lose forgets the pin request requestId, as if the service lost it.
+func (s *PinningService) Lose(requestId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.requests, requestId)
+}
+
+// Calls returns how many requests were made with method, including the
+// ones that failed.
+func (s *PinningService) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[method]
+}
+
+// FailNext answers the next count requests with statusCode.
+func (s *PinningService) FailNext(statusCode int, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.failures = append(s.failures, statusCode)
+	}
+}
+
+func (s *PinningService) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.calls[r.Method]++
+	failure := 0
+	if len(s.failures) > 0 {
+		failure = s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		sendFailure(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid access token")
+		return
+	}
+	if failure != 0 {
+		sendFailure(w, failure, "INTERNAL_SERVER_ERROR", "injected failure")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pins":
+		s.add(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/pins/"):
+		s.mu.Lock()
+		request, ok := s.requests[strings.TrimPrefix(r.URL.Path, "/pins/")]
+		if !ok {
+			s.mu.Unlock()
+			sendFailure(w, http.StatusNotFound, "NOT_FOUND", "")
+			return
+		}
+		status := pinStatus(request)
+		s.mu.Unlock()
+		sendJson(w, status)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/pins/"):
+		requestId := strings.TrimPrefix(r.URL.Path, "/pins/")
+		s.mu.Lock()
+		_, ok := s.requests[requestId]
+		delete(s.requests, requestId)
+		s.mu.Unlock()
+		if !ok {
+			sendFailure(w, http.StatusNotFound, "NOT_FOUND", "")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		sendFailure(w, http.StatusNotFound, "NOT_FOUND", "")
+	}
+}
+
+func (s *PinningService) add(w http.ResponseWriter, r *http.Request) {
+	pin := struct {
+		Cid     string   `json:"cid"`
+		Name    string   `json:"name"`
+		Origins []string `json:"origins"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&pin)
+	if err != nil || pin.Cid == "" {
+		sendFailure(w, http.StatusBadRequest, "BAD_REQUEST", "a cid is required")
+		return
+	}
+
+	if s.OnAdd != nil {
+		s.OnAdd(pin.Cid)
+	}
+
+	s.mu.Lock()
+	s.nextId++
+	request := &PinRequest{
+		RequestId: fmt.Sprintf("request-%d", s.nextId),
+		Status:    "queued",
+		Cid:       pin.Cid,
+		Name:      pin.Name,
+		Origins:   pin.Origins,
+	}
+	s.requests[request.RequestId] = request
+	status := pinStatus(request)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func pinStatus(request *PinRequest) interface{} {
+	return map[string]interface{}{
+		"requestid": request.RequestId,
+		"status":    request.Status,
+		"created":   time.Now().UTC(),
+		"pin": map[string]interface{}{
+			"cid":     request.Cid,
+			"name":    request.Name,
+			"origins": request.Origins,
+		},
+		"delegates": []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWService"},
+	}
+}
+
+// sendFailure answers like the Pinning Service API does when a request
+// fails.
+func sendFailure(w http.ResponseWriter, statusCode int, reason string, details string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"reason": reason, "details": details},
+	})
+}
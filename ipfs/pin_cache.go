@@ -0,0 +1,77 @@
+package ipfs
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	pinnedTTL    = 5 * time.Minute
+	notPinnedTTL = 10 * time.Second
+	maxPinCache  = 10000
+)
+
+// pinCache remembers recent pin checks. Pins made or removed through the
+// client update it right away; the TTLs only bound how long changes made
+// directly on the node go unnoticed.
+type pinCache struct {
+	mu      sync.Mutex
+	entries map[string]pinCacheEntry
+	now     func() time.Time
+}
+
+type pinCacheEntry struct {
+	pinned    bool
+	expiresAt time.Time
+}
+
+func newPinCache() *pinCache {
+	return &pinCache{entries: make(map[string]pinCacheEntry), now: time.Now}
+}
+
+func (pc *pinCache) get(cid string) (pinned bool, ok bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	entry, ok := pc.entries[cid]
+	if !ok || pc.now().After(entry.expiresAt) {
+		return false, false
+	}
+
+	return entry.pinned, true
+}
+
+func (pc *pinCache) set(cid string, pinned bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.entries) >= maxPinCache {
+		pc.evictExpired()
+	}
+	// still full of live entries, start over rather than grow
+	if len(pc.entries) >= maxPinCache {
+		pc.entries = make(map[string]pinCacheEntry)
+	}
+
+	ttl := notPinnedTTL
+	if pinned {
+		ttl = pinnedTTL
+	}
+	pc.entries[cid] = pinCacheEntry{pinned, pc.now().Add(ttl)}
+}
+
+func (pc *pinCache) forget(cid string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.entries, cid)
+}
+
+func (pc *pinCache) evictExpired() {
+	now := pc.now()
+	for cid, entry := range pc.entries {
+		if now.After(entry.expiresAt) {
+			delete(pc.entries, cid)
+		}
+	}
+}
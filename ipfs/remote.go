@@ -0,0 +1,163 @@
+package ipfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Statuses a pinning service reports for a pin request.
+const (
+	RemoteQueued  = "queued"
+	RemotePinning = "pinning"
+	RemotePinned  = "pinned"
+	RemoteFailed  = "failed"
+)
+
+// RemoteClient talks to a service implementing the IPFS Pinning Service
+// API. It doesn't retry, pin requests are queued and retried by the caller.
+type RemoteClient struct {
+	Name       string
+	endpoint   string
+	token      string
+	httpClient *http.Client
+}
+
+// RemotePin is the object a pin request asks the service to pin.
+type RemotePin struct {
+	Cid     string   `json:"cid"`
+	Name    string   `json:"name,omitempty"`
+	Origins []string `json:"origins,omitempty"`
+}
+
+// RemotePinStatus is the state of a pin request on the service.
+type RemotePinStatus struct {
+	RequestId string     `json:"requestid"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Pin       *RemotePin `json:"pin"`
+	Delegates []string   `json:"delegates"`
+}
+
+// RemoteError is a failed request to a pinning service.
+type RemoteError struct {
+	StatusCode int
+	Reason     string
+	Details    string
+}
+
+func (e *RemoteError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("pinning service: status code: %d", e.StatusCode)
+	}
+	if e.Details == "" {
+		return fmt.Sprintf("pinning service: %s (status code: %d)", e.Reason, e.StatusCode)
+	}
+
+	return fmt.Sprintf("pinning service: %s: %s (status code: %d)", e.Reason, e.Details, e.StatusCode)
+}
+
+type remoteFailure struct {
+	Error struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	} `json:"error"`
+}
+
+// NewRemoteClient returns a client for the pinning service rooted at
+// endpoint, authenticating with token.
+func NewRemoteClient(name, endpoint, token string, timeout time.Duration) *RemoteClient {
+	return &RemoteClient{
+		Name:       name,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Add asks the service to pin cid. origins are addresses of nodes that
+// have the content, to fetch it from.
+func (c *RemoteClient) Add(cid, name string, origins []string) (*RemotePinStatus, error) {
+	body, err := json.Marshal(&RemotePin{Cid: cid, Name: name, Origins: origins})
+	if err != nil {
+		return nil, err
+	}
+
+	status := &RemotePinStatus{}
+	err = c.do(http.MethodPost, "/pins", body, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Get returns the state of the pin request requestId.
+func (c *RemoteClient) Get(requestId string) (*RemotePinStatus, error) {
+	status := &RemotePinStatus{}
+	err := c.do(http.MethodGet, "/pins/"+requestId, nil, status)
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// Remove deletes the pin request requestId, unpinning its cid.
+func (c *RemoteClient) Remove(requestId string) error {
+	return c.do(http.MethodDelete, "/pins/"+requestId, nil, nil)
+}
+
+// IsRemoteNotFound reports whether err is the service not knowing a pin
+// request.
+func IsRemoteNotFound(err error) bool {
+	remoteErr, ok := err.(*RemoteError)
+	return ok && remoteErr.StatusCode == http.StatusNotFound
+}
+
+// do sends a request to the service and decodes the response into res
+// unless it's nil.
+func (c *RemoteClient) do(method, path string, body []byte, res interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+		failure := &remoteFailure{}
+		_ = json.Unmarshal(respBody, failure)
+
+		return &RemoteError{
+			StatusCode: resp.StatusCode,
+			Reason:     failure.Error.Reason,
+			Details:    failure.Error.Details,
+		}
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,132 @@
+package ipfs
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sealsurlaw/gouvre/ipfs/ipfstest"
+)
+
+func TestRemoteClient(t *testing.T) {
+	service := ipfstest.NewPinningService("secret")
+	defer service.Close()
+	c := NewRemoteClient("fake", service.URL+"/", "secret", time.Second)
+
+	origins := []string{"/ip4/127.0.0.1/tcp/4001/p2p/12D3KooWFake"}
+	status, err := c.Add("bafkqaaa", "empty", origins)
+	if err != nil {
+		t.Fatalf("Add() error = %s", err)
+	}
+	if status.RequestId == "" || status.Status != RemoteQueued {
+		t.Fatalf("Add() = %+v, want a queued request", status)
+	}
+	if status.Pin == nil || status.Pin.Cid != "bafkqaaa" || status.Pin.Name != "empty" {
+		t.Errorf("Add() pin = %+v, want bafkqaaa named empty", status.Pin)
+	}
+	request := service.Request(status.RequestId)
+	if request == nil || len(request.Origins) != 1 || request.Origins[0] != origins[0] {
+		t.Errorf("request on the service = %+v, want origins %v", request, origins)
+	}
+
+	service.SetStatus(status.RequestId, RemotePinned)
+	got, err := c.Get(status.RequestId)
+	if err != nil {
+		t.Fatalf("Get() error = %s", err)
+	}
+	if got.Status != RemotePinned || len(got.Delegates) == 0 {
+		t.Errorf("Get() = %+v, want pinned with delegates", got)
+	}
+
+	err = c.Remove(status.RequestId)
+	if err != nil {
+		t.Fatalf("Remove() error = %s", err)
+	}
+	if service.Request(status.RequestId) != nil {
+		t.Errorf("request %s wasn't removed", status.RequestId)
+	}
+
+	_, err = c.Get(status.RequestId)
+	if !IsRemoteNotFound(err) {
+		t.Errorf("Get() of a removed request error = %v, want not found", err)
+	}
+	err = c.Remove(status.RequestId)
+	if !IsRemoteNotFound(err) {
+		t.Errorf("Remove() of a removed request error = %v, want not found", err)
+	}
+}
+
+func TestRemoteClientErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		failure    int
+		wantStatus int
+		wantReason string
+		wantMsg    string
+	}{
+		{
+			name:       "bad token",
+			token:      "wrong",
+			wantStatus: http.StatusUnauthorized,
+			wantReason: "UNAUTHORIZED",
+			wantMsg:    "pinning service: UNAUTHORIZED: invalid access token (status code: 401)",
+		},
+		{
+			name:       "service error",
+			token:      "secret",
+			failure:    http.StatusInternalServerError,
+			wantStatus: http.StatusInternalServerError,
+			wantReason: "INTERNAL_SERVER_ERROR",
+			wantMsg:    "pinning service: INTERNAL_SERVER_ERROR: injected failure (status code: 500)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := ipfstest.NewPinningService("secret")
+			defer service.Close()
+			c := NewRemoteClient("fake", service.URL, tt.token, time.Second)
+			if tt.failure != 0 {
+				service.FailNext(tt.failure, 1)
+			}
+
+			_, err := c.Add("bafkqaaa", "", nil)
+			remoteErr, ok := err.(*RemoteError)
+			if !ok {
+				t.Fatalf("Add() error = %v, want a *RemoteError", err)
+			}
+			if remoteErr.StatusCode != tt.wantStatus || remoteErr.Reason != tt.wantReason {
+				t.Errorf("Add() error = %+v, want status %d and reason %s", remoteErr, tt.wantStatus, tt.wantReason)
+			}
+			if remoteErr.Error() != tt.wantMsg {
+				t.Errorf("Error() = %q, want %q", remoteErr.Error(), tt.wantMsg)
+			}
+			if IsRemoteNotFound(err) {
+				t.Errorf("IsRemoteNotFound() = true, want false")
+			}
+		})
+	}
+}
+
+func TestIsRemoteNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "not found", err: &RemoteError{StatusCode: http.StatusNotFound, Reason: "NOT_FOUND"}, want: true},
+		{name: "other status", err: &RemoteError{StatusCode: http.StatusBadRequest}},
+		{name: "other error", err: errors.New("not found")},
+		{name: "nil", err: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRemoteNotFound(tt.err); got != tt.want {
+				t.Errorf("IsRemoteNotFound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
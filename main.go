@@ -1,36 +1,52 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/sealsurlaw/gouvre/config"
 	"github.com/sealsurlaw/gouvre/handler"
+	"github.com/sealsurlaw/gouvre/ipfs"
 	"github.com/sealsurlaw/gouvre/middle"
-	"github.com/sealsurlaw/gouvre/response"
 )
 
 func main() {
-	cfg := config.NewConfig()
-	h := handler.NewHandler(cfg)
-
-	handle("/ping", h.Ping)
-	handle("/files/upload", h.UploadFile)
-	handle("/images/links/thumbnails/batch", h.CreateBatchImageThumbnailLinks)
-	handle("/images/links/thumbnails", h.CreateImageThumbnailLink)
-	handle("/images/links/upload", h.CreateImageUploadLink)
-	handle("/images/links/", h.GetImageFromTokenLink)
-	handle("/images/links", h.CreateImageLink)
-	handle("/images/uploads/", h.UploadImageWithLink)
-	handle("/images/uploads", h.UploadImage)
-	handle("/images/", h.DownloadImage)
-	handle("/ipfs/json", h.AddJsonToIpfs)
-	handle("/ipfs/", h.GetIpfsFile)
-
-	handle("/", func(w http.ResponseWriter, r *http.Request) {
-		response.SendMethodNotFound(w)
-	})
+	checkConfig := flag.Bool("check-config", false, "validate the config file and exit")
+	flag.Parse()
+
+	configFile := "config.json"
+	if flag.NArg() > 0 {
+		configFile = flag.Arg(0)
+	}
+
+	cfg, err := config.NewConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		fmt.Printf("%s is valid\n", configFile)
+		return
+	}
+
+	fmt.Printf("Writing images to %s\n", cfg.BasePath)
+
+	ipfsClient := ipfs.NewClient(cfg.Ipfs.ApiUrl, cfg.Ipfs.AuthHeader, cfg.Ipfs.TimeoutDuration(), cfg.Ipfs.Retries)
+	h := handler.NewHandler(cfg, ipfsClient)
+	go config.Watch(configFile, 5*time.Second, h.Reload)
+	go h.RunThumbnailJanitor()
+	go h.RunRemotePinning()
+	go h.RunIntegrityScrubber()
+	h.StartThumbnailJobs()
+
+	for pattern, routeHandler := range h.Routes() {
+		handle(pattern, routeHandler)
+	}
 
 	fmt.Printf("Starting server at port %s\n", cfg.Port)
 	if err := http.ListenAndServe(fmt.Sprintf(":%s", cfg.Port), nil); err != nil {
@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/sealsurlaw/gouvre/errs"
+	"github.com/sealsurlaw/gouvre/index"
+	"github.com/sealsurlaw/gouvre/ipfs"
 )
 
 type GetImageFromTokenLinkRequest struct {
@@ -52,6 +56,88 @@ func ParseJson(r *http.Request, obj interface{}) error {
 	return nil
 }
 
+// ParseBody reads the request body as is.
+func ParseBody(r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(r.Body)
+}
+
+func ParseListOptions(r *http.Request) (*index.ListOptions, error) {
+	query := r.URL.Query()
+	opts := &index.ListOptions{
+		Prefix: query.Get("prefix"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+		Limit:  100,
+	}
+
+	switch opts.Sort {
+	case "":
+		opts.Sort = index.SortFilename
+	case index.SortFilename, index.SortUploadedAt, index.SortSize:
+	default:
+		return nil, errs.ErrBadRequest
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return nil, errs.ErrBadRequest
+	}
+
+	limitStr := query.Get("limit")
+	if limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > 1000 {
+			return nil, errs.ErrBadRequest
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
+}
+
+func ParseMetadata(r *http.Request) bool {
+	metadataStr := r.URL.Query().Get("metadata")
+	metadata, err := strconv.ParseBool(metadataStr)
+	if metadataStr == "" || err != nil {
+		return false
+	}
+
+	return metadata
+}
+
+func ParseLinks(r *http.Request) bool {
+	linksStr := r.URL.Query().Get("links")
+	links, err := strconv.ParseBool(linksStr)
+	if linksStr == "" || err != nil {
+		return false
+	}
+
+	return links
+}
+
+// ParseThumbnailResolutions reads a comma separated list of resolutions,
+// e.g. ?thumbnails=64,256.
+func ParseThumbnailResolutions(r *http.Request) ([]int, error) {
+	resolutions := []int{}
+	thumbnailsStr := r.URL.Query().Get("thumbnails")
+	if thumbnailsStr == "" {
+		return resolutions, nil
+	}
+
+	for _, resolutionStr := range strings.Split(thumbnailsStr, ",") {
+		resolution, err := strconv.Atoi(strings.TrimSpace(resolutionStr))
+		if err != nil || resolution < 1 {
+			return nil, errs.ErrBadRequest
+		}
+		resolutions = append(resolutions, resolution)
+	}
+
+	return resolutions, nil
+}
+
 func ParseSquare(r *http.Request) bool {
 	squareStr := r.URL.Query().Get("square")
 	square, err := strconv.ParseBool(squareStr)
@@ -117,6 +203,54 @@ func ParseFilenameFromUrl(r *http.Request) (string, error) {
 	return filename, nil
 }
 
+// ParseFilenameFromInfoUrl reads the filename from /images/{file}/info.
+func ParseFilenameFromInfoUrl(r *http.Request) (string, error) {
+	filename, err := ParseFilenameFromUrl(r)
+	if err != nil || !strings.HasSuffix(filename, "/info") {
+		return "", errs.ErrBadRequest
+	}
+
+	filename = strings.TrimSuffix(filename, "/info")
+	if filename == "" {
+		return "", errs.ErrBadRequest
+	}
+
+	return filename, nil
+}
+
+func ParseFilenameFromFilesUrl(r *http.Request) (string, error) {
+	pathArr := strings.SplitN(r.URL.Path, "files/", 2)
+	filename := pathArr[len(pathArr)-1]
+	if len(pathArr) < 2 || filename == "" {
+		return "", errs.ErrBadRequest
+	}
+
+	return filename, nil
+}
+
+// ParseUnpin defaults to true, pins left without files are removed unless
+// the request asks to keep them with unpin=false.
+func ParseUnpin(r *http.Request) bool {
+	unpinStr := r.URL.Query().Get("unpin")
+	unpin, err := strconv.ParseBool(unpinStr)
+	if unpinStr == "" || err != nil {
+		return true
+	}
+
+	return unpin
+}
+
+// ParseRepair returns nil when the request leaves repairing to the config.
+func ParseRepair(r *http.Request) *bool {
+	repairStr := r.URL.Query().Get("repair")
+	repair, err := strconv.ParseBool(repairStr)
+	if err != nil {
+		return nil
+	}
+
+	return &repair
+}
+
 func ParseResolution(r *http.Request) (int, error) {
 	resolutionStr := r.FormValue("resolution")
 	resolution, err := strconv.Atoi(resolutionStr)
@@ -147,3 +281,156 @@ func ParseTokenFromUrl(r *http.Request) (string, error) {
 
 	return token, nil
 }
+
+// ParseTokenFromInfoUrl reads the token from /images/links/{token}/info.
+func ParseTokenFromInfoUrl(r *http.Request) (string, error) {
+	pathArr := strings.Split(strings.TrimSuffix(r.URL.Path, "/info"), "/")
+	token := pathArr[len(pathArr)-1]
+	if token == "" {
+		return "", errs.ErrBadRequest
+	}
+
+	return token, nil
+}
+
+// ParseIpfsPath splits /ipfs/{cid}[/path] into the cid and the cleaned path
+// inside it, which is empty for the cid itself.
+func ParseIpfsPath(r *http.Request) (cid.Cid, string, error) {
+	pathArr := strings.SplitN(r.URL.Path, "ipfs/", 2)
+	if len(pathArr) < 2 {
+		return cid.Undef, "", errs.ErrBadRequest
+	}
+
+	parts := strings.SplitN(pathArr[1], "/", 2)
+	c, err := cid.Decode(parts[0])
+	if err != nil {
+		return cid.Undef, "", errs.ErrBadRequest
+	}
+
+	subPath := ""
+	if len(parts) == 2 {
+		subPath = strings.Trim(path.Clean("/"+parts[1]), "/")
+	}
+
+	return c, subPath, nil
+}
+
+// ParseIpfsFormat reads the format to add content to IPFS in, one of
+// ipfs.Formats, which defaults to a UnixFS file.
+func ParseIpfsFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		return ipfs.FormatFile, nil
+	}
+
+	for _, f := range ipfs.Formats {
+		if format == f {
+			return format, nil
+		}
+	}
+
+	return "", errs.ErrBadRequest
+}
+
+func ParseNameFromQuery(r *http.Request) string {
+	return r.URL.Query().Get("name")
+}
+
+// IsCarRequest reports whether a gateway request asks for a CAR export,
+// with ?format=car or by accepting application/vnd.ipld.car.
+func IsCarRequest(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "car" {
+		return true
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "application/vnd.ipld.car")
+}
+
+// ParseCidFromPinsUrl reads the cid from /ipfs/pins/{cid}.
+func ParseCidFromPinsUrl(r *http.Request) (cid.Cid, error) {
+	pathArr := strings.SplitN(r.URL.Path, "ipfs/pins/", 2)
+	if len(pathArr) < 2 {
+		return cid.Undef, errs.ErrBadRequest
+	}
+
+	c, err := cid.Decode(pathArr[1])
+	if err != nil {
+		return cid.Undef, errs.ErrBadRequest
+	}
+
+	return c, nil
+}
+
+// ParseCidFromFilename reads the cid from the filename of /images/cid/{cid}.
+func ParseCidFromFilename(filename string) (cid.Cid, error) {
+	if !strings.HasPrefix(filename, "cid/") {
+		return cid.Undef, errs.ErrBadRequest
+	}
+
+	c, err := cid.Decode(strings.TrimPrefix(filename, "cid/"))
+	if err != nil {
+		return cid.Undef, errs.ErrBadRequest
+	}
+
+	return c, nil
+}
+
+// ParseRange reads a single "bytes=" range against a resource of size bytes.
+// ok is false when there is no usable Range header and the whole resource
+// should be sent. Ranges outside the resource return
+// errs.ErrRangeNotSatisfiable.
+func ParseRange(r *http.Request, size int64) (offset int64, length int64, ok bool, err error) {
+	rangeStr := r.Header.Get("Range")
+	if !strings.HasPrefix(rangeStr, "bytes=") || strings.Contains(rangeStr, ",") {
+		return 0, 0, false, nil
+	}
+
+	startEnd := strings.SplitN(strings.TrimPrefix(rangeStr, "bytes="), "-", 2)
+	if len(startEnd) != 2 {
+		return 0, 0, false, nil
+	}
+	startStr, endStr := strings.TrimSpace(startEnd[0]), strings.TrimSpace(startEnd[1])
+
+	// suffix range, the last n bytes
+	if startStr == "" {
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, 0, false, nil
+		}
+		if n <= 0 || size == 0 {
+			return 0, 0, false, errs.ErrRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, false, nil
+	}
+	if start >= size {
+		return 0, 0, false, errs.ErrRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, true, nil
+}
+
+// IsInfoRequest reports whether the request asks for a file's info, with
+// a path ending in /info, rather than its content. For /images/{file}/info
+// the handler still has to check that no file is stored under that name.
+func IsInfoRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/info")
+}
@@ -10,10 +10,48 @@ import (
 
 	"github.com/sealsurlaw/gouvre/errs"
 	"github.com/sealsurlaw/gouvre/helper"
+	"github.com/sealsurlaw/gouvre/index"
+	"github.com/sealsurlaw/gouvre/ipfs"
 )
 
+// UploadImageResponse describes a stored upload. Cid covers the file as
+// stored, OriginalCid the file as uploaded when stripping its metadata or
+// normalizing its orientation changed it.
 type UploadImageResponse struct {
-	Cid string `json:"cid"`
+	Filename    string               `json:"filename"`
+	Cid         string               `json:"cid"`
+	OriginalCid string               `json:"originalCid,omitempty"`
+	ContentType string               `json:"contentType"`
+	Size        int                  `json:"size"`
+	Width       int                  `json:"width,omitempty"`
+	Height      int                  `json:"height,omitempty"`
+	Encrypted   bool                 `json:"encrypted"`
+	ExpiresAt   *time.Time           `json:"expiresAt,omitempty"`
+	Url         string               `json:"url,omitempty"`
+	Thumbnails  []*ThumbnailResponse `json:"thumbnails,omitempty"`
+}
+
+type ThumbnailResponse struct {
+	Resolution int    `json:"resolution"`
+	Cropped    bool   `json:"cropped"`
+	Url        string `json:"url"`
+}
+
+type UploadImageWithLinkResponse struct {
+	*UploadImageResponse
+	Jobs []*JobResponse `json:"jobs"`
+}
+
+type JobResponse struct {
+	Id         string    `json:"id"`
+	Url        string    `json:"url"`
+	Filename   string    `json:"filename"`
+	Resolution int       `json:"resolution"`
+	Cropped    bool      `json:"cropped"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
 }
 
 type GetLinkResponse struct {
@@ -27,8 +65,88 @@ type GetThumbnailLinkResponse struct {
 }
 
 type GetThumbnailLinksResponse struct {
-	ExpiresAt     *time.Time        `json:"expiresAt"`
-	FilenameToUrl map[string]string `json:"filenameToUrl"`
+	ExpiresAt     *time.Time                     `json:"expiresAt"`
+	FilenameToUrl map[string]string              `json:"filenameToUrl"`
+	Errors        map[string]*errs.ErrorResponse `json:"errors,omitempty"`
+}
+
+type ImageInfoResponse struct {
+	ContentType string     `json:"contentType,omitempty"`
+	Size        *int       `json:"size,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	Cid         string     `json:"cid,omitempty"`
+	UploadedAt  *time.Time `json:"uploadedAt,omitempty"`
+	Encrypted   bool       `json:"encrypted"`
+	Thumbnails  []string   `json:"thumbnails"`
+}
+
+type IpfsDirectoryResponse struct {
+	Cid   string       `json:"cid"`
+	Path  string       `json:"path"`
+	Links []*ipfs.Link `json:"links"`
+}
+
+type PinResponse struct {
+	Cid        string               `json:"cid"`
+	Pinned     *bool                `json:"pinned,omitempty"`
+	Tracked    bool                 `json:"tracked"`
+	Standalone bool                 `json:"standalone"`
+	Filenames  []string             `json:"filenames"`
+	PinnedAt   *time.Time           `json:"pinnedAt,omitempty"`
+	Remote     []*RemotePinResponse `json:"remote"`
+}
+
+type RemotePinResponse struct {
+	Service   string    `json:"service"`
+	RequestId string    `json:"requestId,omitempty"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ListPinsResponse struct {
+	Pins []*PinResponse `json:"pins"`
+}
+
+type ListImagesResponse struct {
+	Filenames  []string        `json:"filenames"`
+	Files      []*index.Record `json:"files,omitempty"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+type CacheUsageResponse struct {
+	Thumbnails   int        `json:"thumbnails"`
+	Size         int64      `json:"size"`
+	MaxSize      int64      `json:"maxSize"`
+	MaxAge       string     `json:"maxAge"`
+	OldestAccess *time.Time `json:"oldestAccess,omitempty"`
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastEvicted  int        `json:"lastEvicted"`
+	LastFreed    int64      `json:"lastFreed"`
+}
+
+type ScrubResponse struct {
+	Running      bool                    `json:"running"`
+	Repair       bool                    `json:"repair"`
+	StartedAt    time.Time               `json:"startedAt"`
+	FinishedAt   *time.Time              `json:"finishedAt,omitempty"`
+	Checked      int                     `json:"checked"`
+	Unverifiable int                     `json:"unverifiable"`
+	Repaired     int                     `json:"repaired"`
+	Problems     []*ScrubProblemResponse `json:"problems"`
+	Error        string                  `json:"error,omitempty"`
+}
+
+type ScrubProblemResponse struct {
+	StoragePath string   `json:"storagePath"`
+	Filenames   []string `json:"filenames"`
+	Cid         string   `json:"cid,omitempty"`
+	Problem     string   `json:"problem"`
+	Repaired    bool     `json:"repaired"`
+	Error       string   `json:"error,omitempty"`
 }
 
 func SendJson(w http.ResponseWriter, obj interface{}, statusCode int) {
@@ -78,3 +196,11 @@ func SendInvalidAuthToken(w http.ResponseWriter) {
 func SendCouldntFindImage(w http.ResponseWriter, err error) {
 	SendError(w, http.StatusNotFound, "Couldn't find image.", err)
 }
+
+func SendReservedFilename(w http.ResponseWriter) {
+	SendError(w, http.StatusBadRequest, "Filename is reserved.", errs.ErrReservedFilename)
+}
+
+func SendIpfsNotEnabled(w http.ResponseWriter) {
+	SendError(w, http.StatusNotImplemented, "Ipfs is not enabled.", errs.ErrIpfsNotEnabled)
+}
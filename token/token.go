@@ -19,6 +19,12 @@ type TokenData struct {
 	ExpiresAt        int64  `json:"e,omitempty"`
 	EncryptionSecret string `json:"s,omitempty"`
 	Resolutions      []int  `json:"r,omitempty"`
+	IssuedAt         int64  `json:"i,omitempty"`
+	// Original is set when Filename is the name the file was uploaded
+	// under rather than its storage path, which older tokens hold.
+	Original   bool `json:"o,omitempty"`
+	Resolution int  `json:"t,omitempty"`
+	Cropped    bool `json:"c,omitempty"`
 }
 
 func NewTokenizer(encryptionSecret string) (*Tokenizer, error) {
@@ -41,6 +47,7 @@ func (t *Tokenizer) CreateToken(
 	tokenData := TokenData{
 		Filename:         filename,
 		EncryptionSecret: encryptionSecret,
+		IssuedAt:         time.Now().Unix(),
 	}
 	if expiresAt != nil {
 		tokenData.ExpiresAt = expiresAt.Unix()
@@ -48,29 +55,117 @@ func (t *Tokenizer) CreateToken(
 	if resolutions != nil {
 		tokenData.Resolutions = resolutions
 	}
-	tokenBytes := dataToJsonBytes(&tokenData)
+
+	return t.sealToken(&tokenData), nil
+}
+
+// CreateFileToken creates a download link token for an original by the
+// name it was uploaded under, or for one of its thumbnails if resolution
+// is non-zero. The storage path is resolved when the link is used.
+func (t *Tokenizer) CreateFileToken(
+	filename string,
+	expiresAt *time.Time,
+	encryptionSecret string,
+	resolution int,
+	cropped bool,
+) (string, error) {
+	tokenData := TokenData{
+		Filename:         filename,
+		EncryptionSecret: encryptionSecret,
+		IssuedAt:         time.Now().Unix(),
+		Original:         true,
+		Resolution:       resolution,
+		Cropped:          cropped,
+	}
+	if expiresAt != nil {
+		tokenData.ExpiresAt = expiresAt.Unix()
+	}
+
+	return t.sealToken(&tokenData), nil
+}
+
+func (t *Tokenizer) sealToken(tokenData *TokenData) string {
+	tokenBytes := dataToJsonBytes(tokenData)
 
 	nonce := helper.MakeNonce()
 	encryptedBytes := t.aesgcm.Seal(nil, nonce, tokenBytes, nil)
 	encryptedBytes = helper.JoinBytes(nonce, encryptedBytes)
 	encryptedStr := base64.RawURLEncoding.EncodeToString(encryptedBytes)
 
-	return encryptedStr, nil
+	return encryptedStr
+}
+
+// SealSecret encrypts an encryption secret so it can be kept at rest. It's
+// bound to purpose: it only opens with the same purpose, and it never
+// parses as a link token.
+func (t *Tokenizer) SealSecret(purpose string, secret string) string {
+	nonce := helper.MakeNonce()
+	encryptedBytes := t.aesgcm.Seal(nil, nonce, []byte(secret), secretData(purpose))
+	encryptedBytes = helper.JoinBytes(nonce, encryptedBytes)
+
+	return base64.RawURLEncoding.EncodeToString(encryptedBytes)
+}
+
+// OpenSecret decrypts a secret sealed by SealSecret for purpose.
+func (t *Tokenizer) OpenSecret(purpose string, sealed string) (string, error) {
+	sealedBytes, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(sealedBytes) < t.aesgcm.NonceSize() {
+		return "", errs.ErrBadRequest
+	}
+
+	nonce, sealedBytes := helper.SplitJoinedBytes(sealedBytes)
+
+	secret, err := t.aesgcm.Open(nil, nonce, sealedBytes, secretData(purpose))
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// secretData is the additional data sealed secrets are authenticated with,
+// which link tokens don't have.
+func secretData(purpose string) []byte {
+	return []byte("secret " + purpose)
 }
 
 func (t *Tokenizer) ParseToken(
 	token string,
 ) (filename string, expiresAt *time.Time, encryptionSecret string, resolutions []int, err error) {
-	tokenBytes, err := base64.RawURLEncoding.DecodeString(token)
+	tokenData, err := t.ParseTokenData(token)
 	if err != nil {
 		return "", nil, "", nil, err
 	}
 
+	expires := time.Unix(tokenData.ExpiresAt, 0)
+
+	resolutions = []int{}
+	if tokenData.Resolutions != nil {
+		resolutions = tokenData.Resolutions
+	}
+
+	return tokenData.Filename, &expires, tokenData.EncryptionSecret, resolutions, nil
+}
+
+// ParseTokenData decrypts token and returns its raw data, failing with
+// errs.ErrTokenExpired if it has expired.
+func (t *Tokenizer) ParseTokenData(token string) (*TokenData, error) {
+	tokenBytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokenBytes) < t.aesgcm.NonceSize() {
+		return nil, errs.ErrBadRequest
+	}
+
 	nonce, tokenBytes := helper.SplitJoinedBytes(tokenBytes)
 
 	decryptedBytes, err := t.aesgcm.Open(nil, nonce, tokenBytes, nil)
 	if err != nil {
-		return "", nil, "", nil, err
+		return nil, err
 	}
 
 	tokenData := jsonBytesToData(decryptedBytes)
@@ -81,15 +176,10 @@ func (t *Tokenizer) ParseToken(
 	}
 
 	if time.Now().After(expires) {
-		return "", nil, "", nil, errs.ErrTokenExpired
+		return nil, errs.ErrTokenExpired
 	}
 
-	resolutions = []int{}
-	if tokenData.Resolutions != nil {
-		resolutions = tokenData.Resolutions
-	}
-
-	return tokenData.Filename, &expires, tokenData.EncryptionSecret, resolutions, nil
+	return tokenData, nil
 }
 
 func dataToJsonBytes(tokenData *TokenData) []byte {